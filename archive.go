@@ -0,0 +1,106 @@
+package rtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+func WriteArchive(writer io.Writer, trees map[string]*Tree, marshaler func(interface{}) ([]byte, error)) error {
+	names := make([]string, 0, len(trees))
+	for name := range trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buffer bytes.Buffer
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, name := range names {
+		buffer.Reset()
+		if _, err := trees[name].WriteTo(&buffer, marshaler); err != nil {
+			return err
+		}
+		n := binary.PutVarint(lenBuf[:], int64(len(name)))
+		if _, err := writer.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(writer, name); err != nil {
+			return err
+		}
+		n = binary.PutVarint(lenBuf[:], int64(buffer.Len()))
+		if _, err := writer.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		if _, err := writer.Write(buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readArchiveSections(reader io.Reader, f func(name string, section io.Reader) error) error {
+	bufReader := bufio.NewReader(reader)
+	for {
+		size, err := binary.ReadVarint(bufReader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(bufReader, name); err != nil {
+			return err
+		}
+		if size, err = binary.ReadVarint(bufReader); err != nil {
+			return err
+		}
+		section := &io.LimitedReader{R: bufReader, N: size}
+		if err := f(string(name), section); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, section); err != nil {
+			return err
+		}
+		if section.N != 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func ReadArchive(reader io.Reader, unMarshal func(data []byte) (interface{}, error)) (map[string]*Tree, error) {
+	trees := make(map[string]*Tree)
+	err := readArchiveSections(reader, func(name string, section io.Reader) error {
+		tree, err := ReBuildTree(section, unMarshal)
+		if err != nil {
+			return err
+		}
+		trees[name] = tree
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trees, nil
+}
+
+func ReadArchiveTree(reader io.Reader, name string, unMarshal func(data []byte) (interface{}, error)) (*Tree, error) {
+	var tree *Tree
+	err := readArchiveSections(reader, func(section string, sectionReader io.Reader) error {
+		if section != name || tree != nil {
+			return nil
+		}
+		var err error
+		tree, err = ReBuildTree(sectionReader, unMarshal)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return nil, fmt.Errorf("archive section %s not found", name)
+	}
+	return tree, nil
+}
@@ -0,0 +1,40 @@
+package rtree
+
+const arenaChunkSize = 64 << 10
+
+// arena carves prefixes out of large chunks. a chunk stays alive as long as
+// any prefix in it does,trading retained memory for fewer allocations
+type arena struct {
+	chunk []byte
+}
+
+func (a *arena) alloc(size int) []byte {
+	if size > arenaChunkSize/8 {
+		return make([]byte, size)
+	}
+	if len(a.chunk) < size {
+		a.chunk = make([]byte, arenaChunkSize)
+	}
+	data := a.chunk[:size:size]
+	a.chunk = a.chunk[size:]
+	return data
+}
+
+func NewWithArena() *Tree {
+	tree := New()
+	tree.cow.arena = &arena{}
+	return tree
+}
+
+func (c *copyOnWriteContext) makeBytes(size int) []byte {
+	if c.arena == nil {
+		return make([]byte, size)
+	}
+	return c.arena.alloc(size)
+}
+
+func (c *copyOnWriteContext) copyBytes(data []byte) []byte {
+	out := c.makeBytes(len(data))
+	copy(out, data)
+	return out
+}
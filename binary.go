@@ -0,0 +1,69 @@
+package rtree
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+)
+
+// values are gob encoded as interface{},so their concrete types must be
+// registered with gob.Register before MarshalBinary or UnmarshalBinary
+func gobMarshal(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(&value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func gobUnMarshal(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (tree *Tree) MarshalBinary() ([]byte, error) {
+	var buffer bytes.Buffer
+	if _, err := tree.WriteTo(&buffer, gobMarshal); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (tree *Tree) UnmarshalBinary(data []byte) error {
+	rebuild, err := ReBuildTree(bytes.NewReader(data), gobUnMarshal)
+	if err != nil {
+		return err
+	}
+	*tree = *rebuild
+	return nil
+}
+
+// MarshalTo has io.WriterTo semantics,values are gob encoded as in MarshalBinary
+func (tree *Tree) MarshalTo(writer io.Writer) (int64, error) {
+	return tree.WriteTo(writer, gobMarshal)
+}
+
+type countReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom,loading a stream written by MarshalTo
+func (tree *Tree) ReadFrom(reader io.Reader) (int64, error) {
+	counter := &countReader{reader: reader}
+	rebuild, err := ReBuildTree(counter, gobUnMarshal)
+	if err != nil {
+		return counter.count, err
+	}
+	*tree = *rebuild
+	return counter.count, nil
+}
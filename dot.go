@@ -0,0 +1,52 @@
+package rtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+func dotLabel(prefix []byte) string {
+	var buffer bytes.Buffer
+	for _, b := range prefix {
+		switch {
+		case b == '"' || b == '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteByte(b)
+		case b < 0x20 || b >= 0x7f:
+			fmt.Fprintf(&buffer, "\\\\x%02x", b)
+		default:
+			buffer.WriteByte(b)
+		}
+	}
+	return buffer.String()
+}
+
+// WriteDOT writes the tree as a GraphViz digraph,valued nodes are drawn with a double border
+func (tree *Tree) WriteDOT(writer io.Writer) error {
+	var buffer bytes.Buffer
+	var id int
+	var write func(parent int, children children)
+	write = func(parent int, children children) {
+		for _, child := range children {
+			id++
+			self := id
+			fmt.Fprintf(&buffer, "\tn%d [label=\"%s\"", self, dotLabel(child.prefix))
+			if child.value != nil {
+				buffer.WriteString(" peripheries=2")
+			}
+			buffer.WriteString("];\n")
+			fmt.Fprintf(&buffer, "\tn%d -> n%d;\n", parent, self)
+			write(self, child.children)
+		}
+	}
+	buffer.WriteString("digraph rtree {\n\tnode [shape=box];\n\tn0 [label=\"\"")
+	if tree.emptyKeyValue != nil {
+		buffer.WriteString(" peripheries=2")
+	}
+	buffer.WriteString("];\n")
+	write(0, tree.children)
+	buffer.WriteString("}\n")
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
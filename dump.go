@@ -0,0 +1,51 @@
+package rtree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+func escapePrefix(buffer *bytes.Buffer, prefix []byte) {
+	for _, b := range prefix {
+		if b < 0x20 || b >= 0x7f || b == '\\' {
+			fmt.Fprintf(buffer, "\\x%02x", b)
+		} else {
+			buffer.WriteByte(b)
+		}
+	}
+}
+
+func (children children) dump(buffer *bytes.Buffer, depth, maxDepth int) {
+	for _, child := range children {
+		for i := 0; i < depth; i++ {
+			buffer.WriteString("  ")
+		}
+		if maxDepth >= 0 && depth > maxDepth {
+			buffer.WriteString("...\n")
+			return
+		}
+		escapePrefix(buffer, child.prefix)
+		if child.value != nil {
+			buffer.WriteString(" *")
+		}
+		buffer.WriteByte('\n')
+		child.children.dump(buffer, depth+1, maxDepth)
+	}
+}
+
+func (tree *Tree) String() string {
+	return tree.StringDepth(-1)
+}
+
+// StringDepth outlines the nodes one per line indented by depth,valued nodes
+// are marked with '*'. nodes deeper than maxDepth are elided,negative is unlimited
+func (tree *Tree) StringDepth(maxDepth int) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(".")
+	if tree.emptyKeyValue != nil {
+		buffer.WriteString(" *")
+	}
+	buffer.WriteByte('\n')
+	tree.children.dump(&buffer, 1, maxDepth)
+	return buffer.String()
+}
@@ -0,0 +1,24 @@
+package rtree
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Fingerprint hashes the ordered (key, value) pairs,so it only depends on
+// the contents and not on how the nodes are split
+func (tree *Tree) Fingerprint(hashValue func(interface{}) []byte) [32]byte {
+	var fingerprint [32]byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	hash := sha256.New()
+	tree.walkKey(func(key []byte, value interface{}) bool {
+		data := hashValue(userValue(value))
+		hash.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(key)))])
+		hash.Write(key)
+		hash.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(data)))])
+		hash.Write(data)
+		return true
+	})
+	copy(fingerprint[:], hash.Sum(nil))
+	return fingerprint
+}
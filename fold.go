@@ -0,0 +1,102 @@
+package rtree
+
+// FoldTree matches keys ignoring ASCII case,so "Foo" and "foo" are one key.
+// only A-Z are folded,other bytes including UTF-8 letters are compared as is.
+// Walk and range visits report the key as last written
+type FoldTree struct {
+	tree *Tree
+}
+
+type foldEntry struct {
+	key   []byte
+	value interface{}
+}
+
+func NewFold() *FoldTree {
+	return &FoldTree{tree: New()}
+}
+
+func foldKey(key []byte) []byte {
+	folded := make([]byte, len(key))
+	for i, c := range key {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		folded[i] = c
+	}
+	return folded
+}
+
+func (t *FoldTree) Insert(key []byte) {
+	t.ReplaceOrInsert(key, Empty)
+}
+
+func (t *FoldTree) ReplaceOrInsert(key []byte, val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	old := t.tree.ReplaceOrInsert(foldKey(key), foldEntry{key: bytesCopy(key), value: val})
+	if old == nil {
+		return nil
+	}
+	return old.(foldEntry).value
+}
+
+func (t *FoldTree) Get(key []byte) (interface{}, bool) {
+	value, ok := t.tree.Get(foldKey(key))
+	if ok == false {
+		return nil, false
+	}
+	return value.(foldEntry).value, true
+}
+
+func (t *FoldTree) Has(key []byte) bool {
+	return t.tree.Has(foldKey(key))
+}
+
+func (t *FoldTree) Find(key []byte) bool {
+	return t.Has(key)
+}
+
+func (t *FoldTree) Delete(key []byte) {
+	t.tree.Delete(foldKey(key))
+}
+
+func (t *FoldTree) Len() int {
+	return t.tree.Len()
+}
+
+func (t *FoldTree) Walk(f func(key []byte, value interface{}) bool) {
+	t.tree.WalkKeys(func(_ []byte, value interface{}) bool {
+		entry := value.(foldEntry)
+		return f(entry.key, entry.value)
+	})
+}
+
+// AscendRange visits keys in [from, to) comparing the folded keys
+func (t *FoldTree) AscendRange(from, to []byte, f func(key []byte, value interface{}) bool) {
+	if from != nil {
+		from = foldKey(from)
+	}
+	if to != nil {
+		to = foldKey(to)
+	}
+	t.tree.AscendRange(from, to, func(_ []byte, value interface{}) bool {
+		entry := value.(foldEntry)
+		return f(entry.key, entry.value)
+	})
+}
+
+// DescendRange visits keys in (to, from] in descending order
+func (t *FoldTree) DescendRange(from, to []byte, f func(key []byte, value interface{}) bool) {
+	if from != nil {
+		from = foldKey(from)
+	}
+	if to != nil {
+		to = foldKey(to)
+	}
+	t.tree.DescendRange(from, to, func(_ []byte, value interface{}) bool {
+		entry := value.(foldEntry)
+		return f(entry.key, entry.value)
+	})
+}
@@ -0,0 +1,65 @@
+package rtree
+
+func levenshteinRow(prev []int, query []byte, c byte) []int {
+	row := make([]int, len(prev))
+	row[0] = prev[0] + 1
+	for i := 1; i < len(row); i++ {
+		cost := 1
+		if query[i-1] == c {
+			cost = 0
+		}
+		row[i] = prev[i-1] + cost
+		if d := prev[i] + 1; d < row[i] {
+			row[i] = d
+		}
+		if d := row[i-1] + 1; d < row[i] {
+			row[i] = d
+		}
+	}
+	return row
+}
+
+func (children children) fuzzyMatch(query, key []byte, row []int, maxDist int,
+	f func(key []byte, value interface{}, dist int) bool) bool {
+next:
+	for _, child := range children {
+		next := row
+		for _, c := range child.prefix {
+			next = levenshteinRow(next, query, c)
+			min := next[0]
+			for _, d := range next[1:] {
+				if d < min {
+					min = d
+				}
+			}
+			// every key below is at least min edits away
+			if min > maxDist {
+				continue next
+			}
+		}
+		key := append(key, child.prefix...)
+		if dist := next[len(query)]; child.value != nil && dist <= maxDist && f(key, userValue(child.value), dist) == false {
+			return false
+		}
+		if child.children.fuzzyMatch(query, key, next, maxDist, f) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// FuzzyMatch visits keys within maxDist Levenshtein edits of key,pruning
+// subtrees whose best possible distance is already too large
+func (tree *Tree) FuzzyMatch(key []byte, maxDist int, f func(key []byte, value interface{}, dist int) bool) {
+	if maxDist < 0 {
+		return
+	}
+	row := make([]int, len(key)+1)
+	for i := range row {
+		row[i] = i
+	}
+	if tree.emptyKeyValue != nil && len(key) <= maxDist && f([]byte{}, userValue(tree.emptyKeyValue), len(key)) == false {
+		return
+	}
+	tree.children.fuzzyMatch(key, make([]byte, 0, 64), row, maxDist, f)
+}
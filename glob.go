@@ -0,0 +1,100 @@
+package rtree
+
+import "bytes"
+
+// GlobSeparator ends a segment,neither '*' nor '?' match it
+var GlobSeparator byte = '/'
+
+type glob []byte
+
+func (g glob) closure(states []int) []int {
+	for i := 0; i < len(states); i++ {
+		if s := states[i]; s < len(g) && g[s] == '*' && (i+1 == len(states) || states[i+1] != s+1) {
+			states = append(states, 0)
+			copy(states[i+2:], states[i+1:])
+			states[i+1] = s + 1
+		}
+	}
+	return states
+}
+
+func (g glob) step(states []int, c byte) []int {
+	var next []int
+	// states are sorted,so the added states come out sorted as well
+	add := func(s int) {
+		if len(next) == 0 || next[len(next)-1] != s {
+			next = append(next, s)
+		}
+	}
+	for _, s := range states {
+		if s == len(g) {
+			continue
+		}
+		switch g[s] {
+		case '*':
+			if c != GlobSeparator {
+				add(s)
+			}
+		case '?':
+			if c != GlobSeparator {
+				add(s + 1)
+			}
+		default:
+			if g[s] == c {
+				add(s + 1)
+			}
+		}
+	}
+	return g.closure(next)
+}
+
+func (g glob) accept(states []int) bool {
+	return len(states) != 0 && states[len(states)-1] == len(g)
+}
+
+func (children children) matchGlob(g glob, key []byte, states []int, f func(key []byte, value interface{}) bool) bool {
+	for _, child := range children {
+		next := states
+		for _, c := range child.prefix {
+			if next = g.step(next, c); len(next) == 0 {
+				break
+			}
+		}
+		if len(next) == 0 {
+			continue
+		}
+		key := append(key, child.prefix...)
+		if child.value != nil && g.accept(next) && f(key, userValue(child.value)) == false {
+			return false
+		}
+		if child.children.matchGlob(g, key, next, f) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchGlob visits keys matching pattern,where '*' matches any bytes and '?'
+// a single byte within a segment. the literal bytes before the first wildcard
+// select the subtree to search
+func (tree *Tree) MatchGlob(pattern []byte, f func(key []byte, value interface{}) bool) {
+	g := glob(pattern)
+	literal := pattern
+	if i := bytes.IndexAny(pattern, "*?"); i >= 0 {
+		literal = pattern[:i]
+	}
+	if len(literal) == 0 {
+		states := g.closure([]int{0})
+		if tree.emptyKeyValue != nil && g.accept(states) && f([]byte{}, userValue(tree.emptyKeyValue)) == false {
+			return
+		}
+		tree.children.matchGlob(g, make([]byte, 0, 64), states, f)
+		return
+	}
+	n, nodeKey := tree.children.prefixNode(literal)
+	if n == nil {
+		return
+	}
+	key := nodeKey[:len(nodeKey)-len(n.prefix)]
+	children{n}.matchGlob(g, key, g.closure([]int{len(key)}), f)
+}
@@ -0,0 +1,134 @@
+package rtree
+
+import (
+	"bytes"
+	"reflect"
+)
+
+type iteratorItem struct {
+	node   *node
+	keyLen int
+}
+
+// Iterator yields keys in lexicographic order. Mutating the tree while
+// iterating is undefined; iterate a Clone instead.
+type Iterator struct {
+	tree  *Tree
+	stack []iteratorItem
+	key   []byte
+	value interface{}
+}
+
+func (tree *Tree) Iterator() *Iterator {
+	it := &Iterator{tree: tree, key: make([]byte, 0, 64)}
+	it.Seek(nil)
+	return it
+}
+
+// Seek positions the iterator so Next yields the smallest key >= key
+func (it *Iterator) Seek(key []byte) {
+	for i := range it.stack {
+		it.stack[i] = iteratorItem{}
+	}
+	it.stack = it.stack[:0]
+	it.key = it.key[:0]
+	it.value = nil
+	if len(key) == 0 {
+		it.push(it.tree.children, 0)
+		if it.tree.emptyKeyValue != nil {
+			it.push(children{&node{value: it.tree.emptyKeyValue}}, 0)
+		}
+		return
+	}
+	for children := it.tree.children; ; {
+		// siblings after the path are pushed first,so they come out last
+		index, child := children.findNode(key[0])
+		if child == nil {
+			it.push(children[index:], len(it.key))
+			return
+		}
+		it.push(children[index+1:], len(it.key))
+		size := prefixLen(child.prefix, key)
+		switch {
+		case size == len(key):
+			it.push(children[index:index+1], len(it.key))
+			return
+		case size == len(child.prefix):
+			it.key = append(it.key, child.prefix...)
+			key = key[size:]
+			children = child.children
+		default:
+			if child.prefix[size] > key[size] {
+				it.push(children[index:index+1], len(it.key))
+			}
+			return
+		}
+	}
+}
+
+func (it *Iterator) push(children children, keyLen int) {
+	for i := len(children) - 1; i >= 0; i-- {
+		it.stack = append(it.stack, iteratorItem{node: children[i], keyLen: keyLen})
+	}
+}
+
+func (it *Iterator) Next() bool {
+	for len(it.stack) != 0 {
+		item := it.stack[len(it.stack)-1]
+		it.stack[len(it.stack)-1] = iteratorItem{}
+		it.stack = it.stack[:len(it.stack)-1]
+		it.key = append(it.key[:item.keyLen], item.node.prefix...)
+		it.push(item.node.children, len(it.key))
+		if item.node.value != nil {
+			it.value = item.node.value
+			return true
+		}
+	}
+	it.key = it.key[:0]
+	it.value = nil
+	return false
+}
+
+// Key is only valid until the next call to Next
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() interface{} {
+	return userValue(it.value)
+}
+
+// Diff walks both trees in lockstep and reports keys in sorted order,values
+// are compared with reflect.DeepEqual. keys are only valid during the callback
+func Diff(old, new *Tree, onAdd, onDel, onChange func(key []byte, oldVal, newVal interface{})) {
+	oldIt, newIt := old.Iterator(), new.Iterator()
+	oldOk, newOk := oldIt.Next(), newIt.Next()
+	for oldOk || newOk {
+		var c int
+		switch {
+		case oldOk == false:
+			c = 1
+		case newOk == false:
+			c = -1
+		default:
+			c = bytes.Compare(oldIt.Key(), newIt.Key())
+		}
+		switch {
+		case c < 0:
+			if onDel != nil {
+				onDel(oldIt.Key(), oldIt.Value(), nil)
+			}
+			oldOk = oldIt.Next()
+		case c > 0:
+			if onAdd != nil {
+				onAdd(newIt.Key(), nil, newIt.Value())
+			}
+			newOk = newIt.Next()
+		default:
+			if onChange != nil && reflect.DeepEqual(oldIt.Value(), newIt.Value()) == false {
+				onChange(newIt.Key(), oldIt.Value(), newIt.Value())
+			}
+			oldOk, newOk = oldIt.Next(), newIt.Next()
+		}
+	}
+}
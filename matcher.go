@@ -0,0 +1,44 @@
+package rtree
+
+type Matcher struct {
+	children children
+	node     *node
+	offset   int
+	dead     bool
+}
+
+func (tree *Tree) Matcher() *Matcher {
+	return &Matcher{children: tree.children}
+}
+
+func (m *Matcher) Advance(b byte) (matchedValue interface{}, isKey bool, deadEnd bool) {
+	if m.dead {
+		return nil, false, true
+	}
+	if m.node == nil || m.offset == len(m.node.prefix) {
+		if m.node != nil {
+			m.children = m.node.children
+		}
+		_, child := m.children.findNode(b)
+		if child == nil {
+			m.dead = true
+			return nil, false, true
+		}
+		m.node = child
+		m.offset = 0
+	} else if m.node.prefix[m.offset] != b {
+		m.dead = true
+		return nil, false, true
+	}
+	m.offset++
+	if m.offset != len(m.node.prefix) {
+		return nil, false, false
+	}
+	if len(m.node.children) == 0 {
+		m.dead = true
+	}
+	if m.node.value != nil {
+		return userValue(m.node.value), true, m.dead
+	}
+	return nil, false, m.dead
+}
@@ -0,0 +1,36 @@
+package rtree
+
+import "unsafe"
+
+var (
+	treeSize    = int64(unsafe.Sizeof(Tree{}))
+	nodeSize    = int64(unsafe.Sizeof(node{}))
+	pointerSize = int64(unsafe.Sizeof((*node)(nil)))
+)
+
+// MemoryUsage estimates the bytes held by the tree's nodes,prefixes and
+// children slices. nodes shared with a clone are counted by both trees
+func (tree *Tree) MemoryUsage() int64 {
+	return tree.MemoryUsageWithValues(nil)
+}
+
+// MemoryUsageWithValues adds valueSize of every stored value to MemoryUsage
+func (tree *Tree) MemoryUsageWithValues(valueSize func(value interface{}) int64) int64 {
+	usage := treeSize + int64(cap(tree.children))*pointerSize
+	if tree.emptyKeyValue != nil && valueSize != nil {
+		usage += valueSize(userValue(tree.emptyKeyValue))
+	}
+	return usage + tree.children.memoryUsage(valueSize)
+}
+
+func (children children) memoryUsage(valueSize func(value interface{}) int64) int64 {
+	var usage int64
+	for _, child := range children {
+		usage += nodeSize + int64(len(child.prefix)) + int64(cap(child.children))*pointerSize
+		if child.value != nil && valueSize != nil {
+			usage += valueSize(userValue(child.value))
+		}
+		usage += child.children.memoryUsage(valueSize)
+	}
+	return usage
+}
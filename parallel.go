@@ -0,0 +1,177 @@
+package rtree
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+const parallelBatchSize = 1 << 10
+
+type parallelRecord struct {
+	op     byte
+	prefix []byte
+	data   []byte
+	offset int64
+}
+
+// parallelSubtree holds the records of one top level subtree until a worker
+// builds its node
+type parallelSubtree struct {
+	records []parallelRecord
+	node    *node
+	count   int
+	err     error
+}
+
+func (subtree *parallelSubtree) build(cow *copyOnWriteContext, unMarshal func(data []byte) (interface{}, error)) {
+	var stack []*node
+	for _, record := range subtree.records {
+		if record.op == Pop {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		// only the top level empty key may have an empty prefix,with a value
+		// and nothing below it
+		if (len(record.prefix) == 0 && (len(stack) != 0 || record.op == Push)) ||
+			(len(stack) == 1 && len(stack[0].prefix) == 0) {
+			subtree.err = &StreamError{Offset: record.offset, Err: ErrEmptyPrefix}
+			return
+		}
+		if record.op == PushChain {
+			segments, err := chainSegments(record.prefix, record.data)
+			if err != nil {
+				subtree.err = &StreamError{Offset: record.offset, Err: err}
+				return
+			}
+			next := newRNode(cow, segments[0], nil)
+			if len(stack) == 0 {
+				subtree.node = next
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, next)
+			}
+			for _, segment := range segments[1:] {
+				child := newRNode(cow, segment, nil)
+				next.children = append(next.children, child)
+				next = child
+			}
+			stack = append(stack, next)
+			continue
+		}
+		var value interface{}
+		switch record.op {
+		case PushKey:
+			if value, subtree.err = unMarshal(record.data); subtree.err != nil {
+				return
+			}
+		case PushMember:
+			value = Empty
+		case PushNil:
+			value = nilValue{}
+		}
+		if value != nil {
+			subtree.count++
+		}
+		next := newRNode(cow, record.prefix, value)
+		if len(stack) == 0 {
+			subtree.node = next
+		} else {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, next)
+		}
+		stack = append(stack, next)
+	}
+	subtree.records = nil
+}
+
+// ReBuildTreeParallel reads the stream serially and hands the top level
+// subtrees to workers goroutines,which unmarshal the values and build the
+// nodes. subtrees are stitched under the root in stream order,so the result
+// is the same as ReBuildTree. unMarshal must be safe for concurrent use
+func ReBuildTreeParallel(reader io.Reader, unMarshal func(data []byte) (interface{}, error), workers int) (*Tree, error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("bad workers count %d", workers)
+	}
+	streamReader := newStreamReader(reader)
+	if err := streamReader.readHeader(); err != nil {
+		return nil, err
+	}
+	tree := New()
+	jobs := make(chan []*parallelSubtree, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				for _, subtree := range batch {
+					subtree.build(tree.cow, unMarshal)
+				}
+			}
+		}()
+	}
+
+	var subtrees, batch []*parallelSubtree
+	var curr *parallelSubtree
+	var depth, batchSize int
+	var err error
+	for {
+		offset := streamReader.offset
+		var op byte
+		var prefix, data []byte
+		if op, prefix, data, err = streamReader.next(false); err != nil {
+			break
+		}
+		if op == Pop {
+			if depth == 0 {
+				err = &StreamError{Offset: offset, Err: ErrStackError}
+				break
+			}
+			depth--
+		} else {
+			if depth == 0 {
+				curr = &parallelSubtree{}
+				subtrees = append(subtrees, curr)
+				batch = append(batch, curr)
+			}
+			depth++
+		}
+		curr.records = append(curr.records, parallelRecord{op: op, prefix: prefix, data: data, offset: offset})
+		if batchSize++; depth == 0 && batchSize >= parallelBatchSize {
+			jobs <- batch
+			batch, batchSize = nil, 0
+		}
+	}
+	if err == io.EOF {
+		err = nil
+		if depth != 0 {
+			err = &StreamError{Offset: streamReader.offset, Err: ErrBrokenStack}
+		}
+	}
+	if err == nil && len(batch) != 0 {
+		jobs <- batch
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	tree.children = make(children, 0, len(subtrees))
+	for _, subtree := range subtrees {
+		if subtree.err != nil {
+			return nil, subtree.err
+		}
+		if len(subtree.node.prefix) == 0 {
+			tree.emptyKeyValue = subtree.node.value
+			if tree.emptyKeyValue != nil {
+				tree.count++
+			}
+			continue
+		}
+		tree.count += subtree.count
+		tree.children = append(tree.children, subtree.node)
+	}
+	return tree, nil
+}
@@ -4,21 +4,38 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type FreeList struct {
+	// first for 64-bit alignment of the atomic counters
+	hits    int64
+	misses  int64
+	returns int64
+
 	mutex sync.Mutex
 	nodes []*node
 	size  int
 }
 
+const childrenClasses = 8
+
+type childrenFreeList struct {
+	mutex   sync.Mutex
+	classes [childrenClasses][]children
+	size    int
+}
+
 type copyOnWriteContext struct {
-	freelist *FreeList
+	freelist         *FreeList
+	childrenFreeList *childrenFreeList
+	arena            *arena
 }
 
 type children []*node
@@ -33,6 +50,10 @@ type node struct {
 type Tree struct {
 	cow      *copyOnWriteContext
 	children children
+	count    int
+	recorder *recorder
+
+	emptyKeyValue interface{}
 }
 
 func NewFreeList(size int) *FreeList {
@@ -43,6 +64,96 @@ func NewFreeList(size int) *FreeList {
 	}
 }
 
+func newChildrenFreeList(size int) *childrenFreeList {
+	return &childrenFreeList{size: size}
+}
+
+func childrenClass(capacity int) int {
+	class := 0
+	for 2<<class < capacity {
+		class++
+	}
+	return class
+}
+
+func (list *childrenFreeList) get(capacity int) children {
+	if list == nil {
+		return make(children, 0, capacity)
+	}
+	class := childrenClass(capacity)
+	if class >= childrenClasses {
+		return make(children, 0, capacity)
+	}
+	list.mutex.Lock()
+	if size := len(list.classes[class]); size != 0 {
+		c := list.classes[class][size-1]
+		list.classes[class][size-1] = nil
+		list.classes[class] = list.classes[class][:size-1]
+		list.mutex.Unlock()
+		return c
+	}
+	list.mutex.Unlock()
+	return make(children, 0, 2<<class)
+}
+
+func (list *childrenFreeList) put(c children) {
+	if list == nil || cap(c) < 2 {
+		return
+	}
+	class := childrenClass(cap(c))
+	if class >= childrenClasses || 2<<class != cap(c) {
+		return
+	}
+	c = c[:cap(c)]
+	for i := range c {
+		c[i] = nil
+	}
+	list.mutex.Lock()
+	if len(list.classes[class]) < list.size {
+		list.classes[class] = append(list.classes[class], c[:0])
+	}
+	list.mutex.Unlock()
+}
+
+func (c *copyOnWriteContext) insetAt(children *children, node *node, index int) {
+	if len(*children) == cap(*children) {
+		grown := c.childrenFreeList.get(len(*children) + 1)[:len(*children)]
+		copy(grown, *children)
+		c.childrenFreeList.put(*children)
+		*children = grown
+	}
+	children.insetAt(node, index)
+}
+
+func (c *copyOnWriteContext) freeNode(n *node) {
+	if c.resetNode(n) {
+		c.freelist.freeNode(n)
+	}
+}
+
+// resetNode clears a node owned by c so it can go back to the FreeList
+func (c *copyOnWriteContext) resetNode(n *node) bool {
+	if n.cow != c {
+		return false
+	}
+	c.childrenFreeList.put(n.children)
+	n.children = nil
+	n.prefix = nil
+	n.value = nil
+	n.cow = nil
+	return true
+}
+
+func (c *copyOnWriteContext) freeTree(n *node) {
+	if n.cow != c {
+		return
+	}
+	for _, child := range n.children {
+		c.freeTree(child)
+	}
+	c.freeNode(n)
+}
+
 func (c *copyOnWriteContext) newNode() *node {
 	n := c.freelist.newNode()
 	n.cow = c
@@ -60,37 +171,158 @@ func (freelist *FreeList) newNode() *node {
 	}
 	freelist.mutex.Unlock()
 	if n == nil {
+		atomic.AddInt64(&freelist.misses, 1)
 		return new(node)
 	}
+	atomic.AddInt64(&freelist.hits, 1)
 	return n
 }
 
+func (freelist *FreeList) warm(n int) {
+	freelist.mutex.Lock()
+	if n > freelist.size {
+		freelist.size = n
+	}
+	for len(freelist.nodes) < n {
+		freelist.nodes = append(freelist.nodes, new(node))
+	}
+	freelist.mutex.Unlock()
+}
+
 func (freelist *FreeList) freeNode(node *node) {
 	freelist.mutex.Lock()
 	if size := len(freelist.nodes); size < freelist.size {
 		freelist.nodes = append(freelist.nodes, node)
+		atomic.AddInt64(&freelist.returns, 1)
 	}
+	freelist.mutex.Unlock()
+}
+
+func (freelist *FreeList) freeNodes(nodes []*node) {
 	freelist.mutex.Lock()
+	for _, node := range nodes {
+		if len(freelist.nodes) == freelist.size {
+			break
+		}
+		freelist.nodes = append(freelist.nodes, node)
+		atomic.AddInt64(&freelist.returns, 1)
+	}
+	freelist.mutex.Unlock()
+}
+
+func (freelist *FreeList) Stats() (hits, misses, returns int64) {
+	return atomic.LoadInt64(&freelist.hits), atomic.LoadInt64(&freelist.misses), atomic.LoadInt64(&freelist.returns)
 }
 
 var DefaultFreeListSize = 32
 
 func New() *Tree {
 	return &Tree{
-		cow: &copyOnWriteContext{freelist: NewFreeList(DefaultFreeListSize)},
+		cow: &copyOnWriteContext{
+			freelist:         NewFreeList(DefaultFreeListSize),
+			childrenFreeList: newChildrenFreeList(DefaultFreeListSize),
+		},
+	}
+}
+
+// NewWithFreeList builds a tree on an existing FreeList,which may be shared by several trees.
+// a nil freelist gets a new one of DefaultFreeListSize
+func NewWithFreeList(freelist *FreeList) *Tree {
+	if freelist == nil {
+		freelist = NewFreeList(DefaultFreeListSize)
+	}
+	return &Tree{
+		cow: &copyOnWriteContext{
+			freelist:         freelist,
+			childrenFreeList: newChildrenFreeList(freelist.size),
+		},
+	}
+}
+
+func NewWithFreeListSize(size int) (*Tree, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("negative free list size %d", size)
+	}
+	return NewWithFreeList(NewFreeList(size)), nil
+}
+
+func (tree *Tree) WarmFreeList(n int) {
+	if n <= 0 {
+		return
 	}
+	tree.cow.freelist.warm(n)
 }
 
+// Clone gives the receiver a new cow context,so it must not run concurrently
+// with writers or other Clones of the same tree. readers never touch the cow
+// context and may run alongside it,see CloneLocked. the clone shares the node
+// pools of the tree,so concurrent writers to both contend on the pool locks,
+// see CloneIndependentFreeList
 func (tree *Tree) Clone() *Tree {
 	clone := *tree
-	cow1, cow2 := *tree.cow, *tree.cow
 	clone.children = make(children, len(tree.children))
 	copy(clone.children, tree.children)
-	clone.cow = &cow1
-	tree.cow = &cow2
+	clone.cow = tree.fork()
+	clone.recorder = nil
 	return &clone
 }
 
+// CloneIndependentFreeList is Clone giving the clone its own node pools of the
+// same size,so writers to the tree and the clone never share a pool lock
+func (tree *Tree) CloneIndependentFreeList() *Tree {
+	clone := tree.Clone()
+	clone.cow.freelist = NewFreeList(tree.cow.freelist.size)
+	clone.cow.childrenFreeList = newChildrenFreeList(tree.cow.childrenFreeList.size)
+	return clone
+}
+
+// fork moves the receiver to a new cow context and returns another one,so
+// neither side mutates the nodes they now share
+func (tree *Tree) fork() *copyOnWriteContext {
+	cow1, cow2 := *tree.cow, *tree.cow
+	if tree.cow.arena != nil {
+		// arenas are not shared between goroutines
+		cow1.arena, cow2.arena = &arena{}, &arena{}
+	}
+	tree.cow = &cow2
+	return &cow1
+}
+
+// SubTree returns the keys under prefix with prefix stripped,sharing nodes
+// copy-on-write like Clone
+func (tree *Tree) SubTree(prefix []byte) (*Tree, bool) {
+	if len(prefix) == 0 {
+		return tree.Clone(), tree.count != 0
+	}
+	n, nodeKey := tree.children.prefixNode(prefix)
+	if n == nil {
+		return nil, false
+	}
+	count := children{n}.count()
+	if count == 0 {
+		return nil, false
+	}
+	sub := &Tree{cow: tree.fork(), count: count}
+	if leftover := nodeKey[len(prefix):]; len(leftover) == 0 {
+		sub.emptyKeyValue = n.value
+		sub.children = make(children, len(n.children))
+		copy(sub.children, n.children)
+	} else {
+		child := newRNode(sub.cow, sub.cow.copyBytes(leftover), n.value)
+		child.children = sub.cow.childrenFreeList.get(len(n.children))[:len(n.children)]
+		copy(child.children, n.children)
+		sub.children = children{child}
+	}
+	return sub, true
+}
+
+// CloneLocked holds the lock that serializes writers to the tree while cloning
+func (tree *Tree) CloneLocked(locker sync.Locker) *Tree {
+	locker.Lock()
+	defer locker.Unlock()
+	return tree.Clone()
+}
+
 func newRNode(cow *copyOnWriteContext, prefix []byte, value interface{}) *node {
 	n := cow.newNode()
 	n.prefix = prefix
@@ -104,11 +336,29 @@ func (children children) Print() {
 	}
 }
 
+const denseChildren = 16
+
 func (children children) findNode(first byte) (int, *node) {
+	// children holding a contiguous run of first bytes (up to the full 256)
+	// are indexed directly instead of binary searched,an empty prefix sorts
+	// first and never matches. a single gap in the run falls back to the
+	// binary search,see BenchmarkGappedGet
+	if size := len(children); size > denseChildren && len(children[0].prefix) != 0 {
+		low := children[0].prefix[0]
+		if int(children[size-1].prefix[0]-low) == size-1 {
+			if first < low {
+				return 0, nil
+			}
+			if i := int(first - low); i < size {
+				return i, children[i]
+			}
+			return size, nil
+		}
+	}
 	i := sort.Search(len(children), func(i int) bool {
-		return first < children[i].prefix[0]
+		return len(children[i].prefix) != 0 && first < children[i].prefix[0]
 	})
-	if i > 0 && children[i-1].prefix[0] == first {
+	if i > 0 && len(children[i-1].prefix) != 0 && children[i-1].prefix[0] == first {
 		return i - 1, children[i-1]
 	}
 	return i, nil
@@ -116,7 +366,7 @@ func (children children) findNode(first byte) (int, *node) {
 
 func (children *children) insetAt(node *node, index int) {
 	*children = append(*children, nil)
-	if index < len(*children) {
+	if index < len(*children)-1 {
 		copy((*children)[index+1:], (*children)[index:])
 	}
 	(*children)[index] = node
@@ -128,17 +378,21 @@ func (children *children) deleteAt(index int) {
 	*children = (*children)[:len(*children)-1]
 }
 
-func (children *children) delete(cow *copyOnWriteContext, key []byte) {
+func (children *children) delete(cow *copyOnWriteContext, key []byte) interface{} {
+	if len(key) == 0 {
+		return nil
+	}
 	if index, child := children.findNode(key[0]); child != nil {
 		child = children.mutableChild(cow, index)
 		if len(key) < len(child.prefix) ||
 			bytes.Compare(key[:len(child.prefix)], child.prefix) != 0 {
-			return
+			return nil
 		}
 		if len(child.prefix) == len(key) {
+			old := child.value
 			if len(child.children) == 0 {
 				children.deleteAt(index)
-				child.prefix = nil
+				cow.freeNode(child)
 			} else {
 				if len(child.children) == 1 {
 					child.merge()
@@ -146,16 +400,294 @@ func (children *children) delete(cow *copyOnWriteContext, key []byte) {
 					child.value = nil
 				}
 			}
-			return
+			return old
 		}
 		if len(child.children) == 0 {
-			return
+			return nil
+		}
+		old := child.children.delete(cow, key[len(child.prefix):])
+		if child.value == nil {
+			// a value-less single child node left by ReBuildTree ends up empty
+			if len(child.children) == 1 {
+				child.merge()
+			} else if len(child.children) == 0 {
+				children.deleteAt(index)
+				cow.freeNode(child)
+			}
+		}
+		return old
+	}
+	return nil
+}
+
+func (children *children) deletePrefix(cow *copyOnWriteContext, prefix []byte) int {
+	index, child := children.findNode(prefix[0])
+	if child == nil {
+		return 0
+	}
+	size := prefixLen(child.prefix, prefix)
+	if size == len(prefix) {
+		count := child.children.count()
+		if child.value != nil {
+			count++
 		}
-		child.children.delete(cow, key[len(child.prefix):])
-		if len(child.children) == 1 && child.value == nil {
+		children.deleteAt(index)
+		cow.freeTree(child)
+		return count
+	}
+	if size < len(child.prefix) {
+		return 0
+	}
+	child = children.mutableChild(cow, index)
+	count := child.children.deletePrefix(cow, prefix[size:])
+	if child.value == nil {
+		if len(child.children) == 1 {
 			child.merge()
+		} else if len(child.children) == 0 {
+			children.deleteAt(index)
+			cow.freeNode(child)
+		}
+	}
+	return count
+}
+
+// deleteSorted deletes sorted unique keys whose first depth bytes are the
+// path to children,collecting the freed nodes
+func (children *children) deleteSorted(cow *copyOnWriteContext, keys [][]byte, depth int, freed *[]*node) int {
+	var count int
+	for len(keys) != 0 {
+		first := keys[0][depth]
+		end := 1
+		for end < len(keys) && keys[end][depth] == first {
+			end++
+		}
+		group := keys[:end]
+		keys = keys[end:]
+		index, child := children.findNode(first)
+		if child == nil {
+			continue
+		}
+		child = children.mutableChild(cow, index)
+		next := depth + len(child.prefix)
+		rest := group[:0]
+		for _, key := range group {
+			if len(key) < next || bytes.Equal(key[depth:next], child.prefix) == false {
+				continue
+			}
+			if len(key) > next {
+				rest = append(rest, key)
+			} else if child.value != nil {
+				child.value = nil
+				count++
+			}
+		}
+		if len(rest) != 0 {
+			count += child.children.deleteSorted(cow, rest, next, freed)
+		}
+		if child.value == nil {
+			if len(child.children) == 1 {
+				child.merge()
+			} else if len(child.children) == 0 {
+				children.deleteAt(index)
+				if cow.resetNode(child) {
+					*freed = append(*freed, child)
+				}
+			}
+		}
+	}
+	return count
+}
+
+// mapValues maps the stored values,a nil result deletes the key
+func (children *children) mapValues(cow *copyOnWriteContext, key []byte,
+	f func(key []byte, old interface{}) interface{}) int {
+	var deleted int
+	for index := 0; index < len(*children); {
+		child := children.mutableChild(cow, index)
+		key := append(key, child.prefix...)
+		if child.value != nil {
+			if child.value = f(key, child.value); child.value == nil {
+				deleted++
+			}
+		}
+		deleted += child.children.mapValues(cow, key, f)
+		size := len(*children)
+		if children.compact(cow, index); len(*children) == size {
+			index++
+		}
+	}
+	return deleted
+}
+
+// truncateHead keeps the first keep keys,whole subtrees past them are freed
+// without visiting their keys one delete at a time
+func (children *children) truncateHead(cow *copyOnWriteContext, keep int) int {
+	var deleted int
+	for index := 0; index < len(*children); index++ {
+		child := (*children)[index]
+		count := child.children.count()
+		if child.value != nil {
+			count++
+		}
+		if count <= keep {
+			keep -= count
+			continue
+		}
+		cut := index + 1
+		if keep == 0 {
+			cut = index
+		}
+		deleted += children.freeRange(cow, cut, len(*children))
+		if keep == 0 {
+			break
+		}
+		child = children.mutableChild(cow, index)
+		if child.value != nil {
+			keep--
+		}
+		deleted += child.children.truncateHead(cow, keep)
+		children.compact(cow, index)
+		break
+	}
+	return deleted
+}
+
+// truncateTail keeps the last keep keys
+func (children *children) truncateTail(cow *copyOnWriteContext, keep int) int {
+	var deleted int
+	for index := len(*children) - 1; index >= 0; index-- {
+		child := (*children)[index]
+		count := child.children.count()
+		if child.value != nil {
+			count++
+		}
+		if count <= keep {
+			keep -= count
+			continue
+		}
+		cut := index
+		if keep == 0 {
+			cut = index + 1
+		}
+		deleted += children.freeRange(cow, 0, cut)
+		if keep == 0 {
+			break
+		}
+		// the node's own key sorts before its children,so it goes first
+		child = children.mutableChild(cow, 0)
+		if child.value != nil {
+			child.value = nil
+			deleted++
+		}
+		deleted += child.children.truncateTail(cow, keep)
+		children.compact(cow, 0)
+		break
+	}
+	return deleted
+}
+
+// freeRange drops the children in [from, to),returning the keys removed
+func (children *children) freeRange(cow *copyOnWriteContext, from, to int) int {
+	removed := (*children)[from:to]
+	count := removed.count()
+	for _, child := range removed {
+		cow.freeTree(child)
+	}
+	n := from + copy((*children)[from:], (*children)[to:])
+	for i := n; i < len(*children); i++ {
+		(*children)[i] = nil
+	}
+	*children = (*children)[:n]
+	return count
+}
+
+// rangeEdge places a child prefix against a range bound,-1 when the whole
+// subtree sorts before bound,1 when it sorts at or after it and 0 when the
+// prefix is a proper prefix of bound,so bound splits the subtree
+func rangeEdge(prefix, bound []byte) int {
+	n := len(prefix)
+	if len(bound) < n {
+		n = len(bound)
+	}
+	if cmp := bytes.Compare(prefix[:n], bound[:n]); cmp != 0 {
+		return cmp
+	}
+	if len(prefix) < len(bound) {
+		return 0
+	}
+	return 1
+}
+
+// deleteRange deletes the keys in [from, to),to bounds the range only when
+// bounded is set. children between the edges are freed whole,only the
+// children split by from or to are copied and descended into
+func (children *children) deleteRange(cow *copyOnWriteContext, from, to []byte, bounded bool) int {
+	var deleted int
+	for index := 0; index < len(*children); {
+		prefix := (*children)[index].prefix
+		lower := rangeEdge(prefix, from)
+		if lower < 0 {
+			index++
+			continue
+		}
+		upper := -1
+		if bounded {
+			upper = rangeEdge(prefix, to)
+		}
+		if upper > 0 {
+			break
+		}
+		if lower > 0 && upper < 0 {
+			end := index + 1
+			for end < len(*children) && (bounded == false || rangeEdge((*children)[end].prefix, to) < 0) {
+				end++
+			}
+			deleted += children.freeRange(cow, index, end)
+			continue
+		}
+		child := children.mutableChild(cow, index)
+		var childFrom, childTo []byte
+		if lower == 0 {
+			childFrom = from[len(prefix):]
+		} else if child.value != nil {
+			child.value = nil
+			deleted++
+		}
+		if upper == 0 {
+			childTo = to[len(prefix):]
+		}
+		deleted += child.children.deleteRange(cow, childFrom, childTo, upper == 0)
+		size := len(*children)
+		if children.compact(cow, index); len(*children) == size {
+			index++
+		}
+	}
+	return deleted
+}
+
+// compact merges or drops the child at index once it lost its value or children
+func (children *children) compact(cow *copyOnWriteContext, index int) {
+	child := (*children)[index]
+	if child.value != nil {
+		return
+	}
+	if len(child.children) == 1 {
+		child.merge()
+	} else if len(child.children) == 0 {
+		children.deleteAt(index)
+		cow.freeNode(child)
+	}
+}
+
+func (children children) count() int {
+	var count int
+	for _, child := range children {
+		if child.value != nil {
+			count++
 		}
+		count += child.children.count()
 	}
+	return count
 }
 
 func (children *children) mutableChild(cow *copyOnWriteContext, index int) *node {
@@ -167,82 +699,1233 @@ func (children *children) mutableChild(cow *copyOnWriteContext, index int) *node
 	return c
 }
 
-func (children children) walk(stack [][]byte, f func(prefixes [][]byte, value interface{}) bool) bool {
+func (children children) walk(stack [][]byte, f func(prefixes [][]byte, value interface{}) bool) bool {
+	for _, child := range children {
+		stack := append(stack, child.prefix)
+		if child.value != nil {
+			prefixes := make([][]byte, len(stack))
+			copy(prefixes, stack)
+			if f(prefixes, userValue(child.value)) == false {
+				return false
+			}
+		}
+		if child.children.walk(stack, f) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (children children) walkKey(key []byte, f func(key []byte, value interface{}) bool) bool {
+	for _, child := range children {
+		key := append(key, child.prefix...)
+		if child.value != nil {
+			if f(key, child.value) == false {
+				return false
+			}
+		}
+		if child.children.walkKey(key, f) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// walkFrom walks the keys >= start,skipping the subtrees below it without
+// visiting them
+func (children children) walkFrom(key, start []byte, f func(key []byte, value interface{}) bool) bool {
+	index, child := children.findNode(start[0])
+	if child != nil {
+		size := prefixLen(child.prefix, start)
+		switch {
+		case size == len(start):
+			if children[index:index+1].walkKey(key, f) == false {
+				return false
+			}
+		case size == len(child.prefix):
+			if child.children.walkFrom(append(key, child.prefix...), start[size:], f) == false {
+				return false
+			}
+		case child.prefix[size] > start[size]:
+			if children[index:index+1].walkKey(key, f) == false {
+				return false
+			}
+		}
+		index++
+	}
+	return children[index:].walkKey(key, f)
+}
+
+func (children children) walkRange(key, lo []byte, loInc bool, hi []byte, hiInc bool,
+	f func(key []byte, value interface{}) bool) bool {
+	for _, child := range children {
+		key := append(key, child.prefix...)
+		var atHi bool
+		if hi != nil {
+			c := bytes.Compare(key, hi)
+			if c > 0 || (c == 0 && hiInc == false) {
+				return false
+			}
+			atHi = c == 0
+		}
+		if lo != nil {
+			c := bytes.Compare(key, lo)
+			if c < 0 && bytes.HasPrefix(lo, key) == false {
+				continue
+			}
+			if child.value != nil && (c > 0 || (c == 0 && loInc)) {
+				if f(key, child.value) == false {
+					return false
+				}
+			}
+		} else if child.value != nil {
+			if f(key, child.value) == false {
+				return false
+			}
+		}
+		if atHi {
+			return false
+		}
+		if child.children.walkRange(key, lo, loInc, hi, hiInc, f) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (children children) prefixNode(prefix []byte) (*node, []byte) {
+	var key []byte
+	for len(prefix) != 0 {
+		_, child := children.findNode(prefix[0])
+		if child == nil {
+			return nil, nil
+		}
+		size := prefixLen(child.prefix, prefix)
+		key = append(key, child.prefix...)
+		if size == len(prefix) {
+			return child, key
+		}
+		if size < len(child.prefix) {
+			return nil, nil
+		}
+		prefix = prefix[size:]
+		children = child.children
+	}
+	return nil, nil
+}
+
+func (children children) any(pred func(value interface{}) bool) bool {
+	for _, child := range children {
+		if child.value != nil && pred(child.value) {
+			return true
+		}
+		if child.children.any(pred) {
+			return true
+		}
+	}
+	return false
+}
+
+func (children children) walkSiblingGroups(key []byte,
+	f func(parentKey []byte, firstBytes []byte, values []interface{}) bool) bool {
+	firstBytes := make([]byte, len(children))
+	values := make([]interface{}, len(children))
+	for i, child := range children {
+		firstBytes[i] = child.prefix[0]
+		values[i] = userValue(child.value)
+	}
+	if f(key, firstBytes, values) == false {
+		return false
+	}
+	for _, child := range children {
+		if len(child.children) == 0 {
+			continue
+		}
+		if child.children.walkSiblingGroups(append(key, child.prefix...), f) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (children children) descendRange(key, from, to []byte, f func(key []byte, value interface{}) bool) bool {
+	for i := len(children) - 1; i >= 0; i-- {
+		child := children[i]
+		key := append(key, child.prefix...)
+		if from != nil && bytes.Compare(key, from) > 0 {
+			continue
+		}
+		var c = 1
+		if to != nil {
+			if c = bytes.Compare(key, to); c < 0 && bytes.HasPrefix(to, key) == false {
+				return false
+			}
+		}
+		if child.children.descendRange(key, from, to, f) == false {
+			return false
+		}
+		if child.value != nil && c > 0 && (from == nil || bytes.Compare(key, from) <= 0) {
+			if f(key, child.value) == false {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (n *node) find(key []byte) bool {
+	if n.value != nil && bytes.Compare(n.prefix, key) == 0 {
+		return true
+	}
+	if len(key) <= len(n.prefix) || bytes.HasPrefix(key, n.prefix) == false {
+		return false
+	}
+	key = key[len(n.prefix):]
+	if _, child := n.children.findNode(key[0]); child == nil {
+		return false
+	} else {
+		return child.find(key)
+	}
+}
+
+func (children children) get(key []byte) *node {
+	for len(key) != 0 {
+		_, child := children.findNode(key[0])
+		if child == nil || bytes.HasPrefix(key, child.prefix) == false {
+			return nil
+		}
+		key = key[len(child.prefix):]
+		if len(key) == 0 {
+			return child
+		}
+		children = child.children
+	}
+	return nil
+}
+
+func (tree *Tree) Get(key []byte) (interface{}, bool) {
+	if len(key) == 0 {
+		return userValue(tree.emptyKeyValue), tree.emptyKeyValue != nil
+	}
+	if n := tree.children.get(key); n != nil && n.value != nil {
+		return userValue(n.value), true
+	}
+	return nil, false
+}
+
+func (tree *Tree) LongestPrefix(key []byte) ([]byte, interface{}, bool) {
+	var size, match int
+	var value = tree.emptyKeyValue
+	children := tree.children
+	for size < len(key) {
+		_, child := children.findNode(key[size])
+		if child == nil || bytes.HasPrefix(key[size:], child.prefix) == false {
+			break
+		}
+		size += len(child.prefix)
+		if child.value != nil {
+			match, value = size, child.value
+		}
+		children = child.children
+	}
+	if value == nil {
+		return nil, nil, false
+	}
+	return bytesCopy(key[:match]), userValue(value), true
+}
+
+// Min returns the smallest key,the empty key sorts before all others
+func (tree *Tree) Min() ([]byte, interface{}, bool) {
+	if tree.emptyKeyValue != nil {
+		return []byte{}, userValue(tree.emptyKeyValue), true
+	}
+	var key []byte
+	for children := tree.children; len(children) != 0; {
+		child := children[0]
+		key = append(key, child.prefix...)
+		if child.value != nil {
+			return key, userValue(child.value), true
+		}
+		children = child.children
+	}
+	return nil, nil, false
+}
+
+// LongestCommonPrefix returns a copy of the prefix shared by every key
+func (tree *Tree) LongestCommonPrefix() []byte {
+	var key []byte
+	if tree.emptyKeyValue != nil {
+		return key
+	}
+	for children := tree.children; len(children) == 1; {
+		child := children[0]
+		key = append(key, child.prefix...)
+		if child.value != nil {
+			break
+		}
+		children = child.children
+	}
+	return key
+}
+
+func (tree *Tree) Max() ([]byte, interface{}, bool) {
+	var key []byte
+	var size int
+	var value interface{}
+	for children := tree.children; len(children) != 0; {
+		child := children[len(children)-1]
+		key = append(key, child.prefix...)
+		if child.value != nil {
+			size, value = len(key), child.value
+		}
+		children = child.children
+	}
+	if value == nil {
+		if tree.emptyKeyValue != nil {
+			return []byte{}, userValue(tree.emptyKeyValue), true
+		}
+		return nil, nil, false
+	}
+	return key[:size], userValue(value), true
+}
+
+// Floor returns the largest key <= key
+func (tree *Tree) Floor(key []byte) ([]byte, interface{}, bool) {
+	var floor []byte
+	var value interface{}
+	if len(key) != 0 {
+		tree.children.descendRange(make([]byte, 0, 64), key, nil, func(k []byte, v interface{}) bool {
+			floor, value = bytesCopy(k), v
+			return false
+		})
+	}
+	if value == nil && tree.emptyKeyValue != nil {
+		return []byte{}, userValue(tree.emptyKeyValue), true
+	}
+	return floor, userValue(value), value != nil
+}
+
+// Ceiling returns the smallest key >= key
+func (tree *Tree) Ceiling(key []byte) ([]byte, interface{}, bool) {
+	if len(key) == 0 && tree.emptyKeyValue != nil {
+		return []byte{}, userValue(tree.emptyKeyValue), true
+	}
+	var ceiling []byte
+	var value interface{}
+	tree.children.walkRange(make([]byte, 0, 64), key, true, nil, false, func(k []byte, v interface{}) bool {
+		ceiling, value = bytesCopy(k), v
+		return false
+	})
+	return ceiling, userValue(value), value != nil
+}
+
+// Next returns the smallest key > key
+func (tree *Tree) Next(key []byte) ([]byte, interface{}, bool) {
+	var next []byte
+	var value interface{}
+	tree.children.walkRange(make([]byte, 0, 64), key, false, nil, false, func(k []byte, v interface{}) bool {
+		next, value = bytesCopy(k), v
+		return false
+	})
+	return next, userValue(value), value != nil
+}
+
+// Prev returns the largest key < key
+func (tree *Tree) Prev(key []byte) ([]byte, interface{}, bool) {
+	var prev []byte
+	var value interface{}
+	if len(key) == 0 {
+		return nil, nil, false
+	}
+	tree.children.descendRange(make([]byte, 0, 64), key, nil, func(k []byte, v interface{}) bool {
+		if bytes.Equal(k, key) {
+			return true
+		}
+		prev, value = bytesCopy(k), v
+		return false
+	})
+	if value == nil && tree.emptyKeyValue != nil {
+		return []byte{}, userValue(tree.emptyKeyValue), true
+	}
+	return prev, userValue(value), value != nil
+}
+
+// Deprecated: Find is an exact match,use Has
+func (tree *Tree) Find(key []byte) bool {
+	return tree.Has(key)
+}
+
+func (tree *Tree) Has(key []byte) bool {
+	if len(key) == 0 {
+		return tree.emptyKeyValue != nil
+	}
+	if tree.children == nil {
+		return false
+	}
+	if _, child := tree.children.findNode(key[0]); child == nil {
+		return false
+	} else {
+		return child.find(key)
+	}
+}
+
+func (tree *Tree) FindReader(reader io.Reader) (bool, error) {
+	var first [1]byte
+	var buffer []byte
+	var curr *node
+	children := tree.children
+	for {
+		if _, err := io.ReadFull(reader, first[:]); err != nil {
+			if err == io.EOF {
+				if curr == nil {
+					return tree.emptyKeyValue != nil, nil
+				}
+				return curr.value != nil, nil
+			}
+			return false, err
+		}
+		_, child := children.findNode(first[0])
+		if child == nil {
+			return false, nil
+		}
+		if size := len(child.prefix) - 1; size > 0 {
+			if cap(buffer) < size {
+				buffer = make([]byte, size)
+			}
+			if _, err := io.ReadFull(reader, buffer[:size]); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return false, nil
+				}
+				return false, err
+			}
+			if bytes.Compare(buffer[:size], child.prefix[1:]) != 0 {
+				return false, nil
+			}
+		}
+		curr = child
+		children = child.children
+	}
+}
+
+func bytesCopy(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	return out
+}
+
+func (tree *Tree) ReplaceOrInsert(key []byte, val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	if tree.recorder != nil {
+		tree.recorder.record(OpReplaceOrInsert, key, val)
+	}
+	return userValue(tree.replaceOrInsert(key, val))
+}
+
+// Set stores val under key,unlike ReplaceOrInsert a nil val is kept and the
+// key reads back as present with a nil value
+func (tree *Tree) Set(key []byte, val interface{}) {
+	if tree.recorder != nil {
+		tree.recorder.record(OpSet, key, val)
+	}
+	tree.replaceOrInsert(key, storedValue(val))
+}
+
+// nilValue stands in for a nil stored by Set,as a node without a value
+// already holds nil
+type nilValue struct{}
+
+func storedValue(value interface{}) interface{} {
+	if value == nil {
+		return nilValue{}
+	}
+	return value
+}
+
+// userValue turns the stand-in back into the nil the caller stored
+func userValue(value interface{}) interface{} {
+	if _, ok := value.(nilValue); ok {
+		return nil
+	}
+	return value
+}
+
+func userValues(f func(key []byte, value interface{}) bool) func(key []byte, value interface{}) bool {
+	return func(key []byte, value interface{}) bool {
+		return f(key, userValue(value))
+	}
+}
+
+func (tree *Tree) replaceOrInsert(key []byte, val interface{}) interface{} {
+	if len(key) == 0 {
+		old := tree.emptyKeyValue
+		if old == nil {
+			tree.count++
+		}
+		tree.emptyKeyValue = val
+		return old
+	}
+	index, child := tree.children.findNode(key[0])
+	if child == nil {
+		tree.cow.insetAt(&tree.children, newRNode(tree.cow, key, val), index)
+		tree.count++
+		return nil
+	}
+	old := tree.children.mutableChild(tree.cow, index).replaceOrInsert(key, val, true)
+	if old == nil {
+		tree.count++
+	}
+	return old
+}
+
+func (tree *Tree) Upsert(key []byte, fn func(old interface{}, existed bool) interface{}) interface{} {
+	old, existed := tree.Get(key)
+	val := fn(old, existed)
+	if val != nil {
+		tree.ReplaceOrInsert(key, val)
+	}
+	return val
+}
+
+// CompareAndSwap replaces the value of an existing key only if equal reports
+// it still matches old,a nil new is stored as Set stores it
+func (tree *Tree) CompareAndSwap(key []byte, old, new interface{}, equal func(a, b interface{}) bool) bool {
+	value, ok := tree.Get(key)
+	if ok == false || equal(value, old) == false {
+		return false
+	}
+	tree.Set(key, new)
+	return true
+}
+
+func (tree *Tree) GetOrInsert(key []byte, val interface{}) (actual interface{}, loaded bool) {
+	if val == nil {
+		return nil, false
+	}
+	if tree.recorder != nil {
+		tree.recorder.record(OpGetOrInsert, key, val)
+	}
+	if len(key) == 0 {
+		if tree.emptyKeyValue != nil {
+			return userValue(tree.emptyKeyValue), true
+		}
+		tree.emptyKeyValue = val
+		tree.count++
+		return val, false
+	}
+	index, child := tree.children.findNode(key[0])
+	if child == nil {
+		tree.cow.insetAt(&tree.children, newRNode(tree.cow, key, val), index)
+		tree.count++
+		return val, false
+	}
+	if old := tree.children.mutableChild(tree.cow, index).replaceOrInsert(key, val, false); old != nil {
+		return userValue(old), true
+	}
+	tree.count++
+	return val, false
+}
+
+// Empty is the value Insert stores for set members,it is told apart from
+// equal bytes by identity,see IsEmpty
+var Empty = []byte{'e', 'm', 'p', 't', 'y'}
+
+// IsEmpty reports whether value is the Empty sentinel itself
+func IsEmpty(value interface{}) bool {
+	data, ok := value.([]byte)
+	return ok && len(data) == len(Empty) && len(data) != 0 && &data[0] == &Empty[0]
+}
+
+// IsMember reports whether key was inserted as a set member by Insert
+func (tree *Tree) IsMember(key []byte) bool {
+	value, ok := tree.Get(key)
+	return ok && IsEmpty(value)
+}
+
+// BulkInsertSorted keeps the rightmost path of the previous key and only
+// descends from where the next key diverges,nil values inserts Empty. the
+// order is checked before any insert,so unsorted keys leave the tree as is
+func (tree *Tree) BulkInsertSorted(keys [][]byte, values []interface{}) error {
+	if values != nil && len(values) != len(keys) {
+		return fmt.Errorf("%d keys but %d values", len(keys), len(values))
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) > 0 {
+			return fmt.Errorf("keys not sorted at index %d", i)
+		}
+	}
+	cursor := sortedCursor{tree: tree}
+	for i, key := range keys {
+		var val interface{} = Empty
+		if values != nil {
+			if val = values[i]; val == nil {
+				continue
+			}
+		}
+		cursor.insert(key, val)
+	}
+	return nil
+}
+
+// LoadSortedLines builds a tree from newline separated sorted keys with the
+// cursor of BulkInsertSorted,skipping empty lines. value derives the value of
+// each key,which is only valid during the call. a nil value func or value
+// stores Empty. a line may be up to MaxStreamFieldSize bytes,the longest key
+// a stream holds,a longer one fails with bufio.ErrTooLong
+func LoadSortedLines(r io.Reader, value func(key []byte) interface{}) (*Tree, error) {
+	tree := New()
+	cursor := sortedCursor{tree: tree}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), int(MaxStreamFieldSize))
+	for line := 1; scanner.Scan(); line++ {
+		key := scanner.Bytes()
+		if len(key) == 0 {
+			continue
+		}
+		if bytes.Compare(cursor.prev, key) > 0 {
+			return nil, fmt.Errorf("line %d out of order", line)
+		}
+		var val interface{} = Empty
+		if value != nil {
+			if val = value(key); val == nil {
+				val = Empty
+			}
+		}
+		cursor.insert(key, val)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+type sortedPathItem struct {
+	node *node
+	end  int
+}
+
+// sortedCursor holds the rightmost path of the last key inserted
+type sortedCursor struct {
+	tree *Tree
+	path []sortedPathItem
+	prev []byte
+}
+
+func (cursor *sortedCursor) insert(key []byte, val interface{}) {
+	tree := cursor.tree
+	if tree.recorder != nil {
+		if _, null := val.(nilValue); null {
+			tree.recorder.record(OpSet, key, nil)
+		} else {
+			tree.recorder.record(OpReplaceOrInsert, key, val)
+		}
+	}
+	if len(key) == 0 {
+		if tree.emptyKeyValue == nil {
+			tree.count++
+		}
+		tree.emptyKeyValue = val
+		return
+	}
+	size := prefixLen(cursor.prev, key)
+	for len(cursor.path) != 0 && cursor.path[len(cursor.path)-1].end > size {
+		cursor.path = cursor.path[:len(cursor.path)-1]
+	}
+	cursor.prev = append(cursor.prev[:0], key...)
+	var n *node
+	var start int
+	if len(cursor.path) != 0 {
+		last := cursor.path[len(cursor.path)-1]
+		n, start = last.node, last.end
+	}
+	if start == len(key) {
+		if n.value == nil {
+			tree.count++
+		}
+		n.value = val
+		return
+	}
+	parent := &tree.children
+	if n != nil {
+		parent = &n.children
+	}
+	index, child := parent.findNode(key[start])
+	if child == nil {
+		child = newRNode(tree.cow, tree.cow.copyBytes(key[start:]), val)
+		tree.cow.insetAt(parent, child, index)
+		tree.count++
+		cursor.path = append(cursor.path, sortedPathItem{node: child, end: len(key)})
+		return
+	}
+	if n == nil {
+		child = tree.children.mutableChild(tree.cow, index)
+	} else {
+		child = n.mutableChild(index)
+	}
+	if child.replaceOrInsert(key[start:], val, true) == nil {
+		tree.count++
+	}
+	for {
+		start += len(child.prefix)
+		cursor.path = append(cursor.path, sortedPathItem{node: child, end: start})
+		if start == len(key) {
+			break
+		}
+		index, _ := child.children.findNode(key[start])
+		child = child.mutableChild(index)
+	}
+}
+
+func (tree *Tree) Insert(key []byte) {
+	if tree.recorder != nil {
+		tree.recorder.record(OpInsert, key, nil)
+	}
+	if len(key) == 0 {
+		if tree.emptyKeyValue == nil {
+			tree.count++
+		}
+		tree.emptyKeyValue = Empty
+		return
+	}
+	index, child := tree.children.findNode(key[0])
+	if child == nil {
+		tree.cow.insetAt(&tree.children, newRNode(tree.cow, key, Empty), index)
+		tree.count++
+	} else if tree.children.mutableChild(tree.cow, index).replaceOrInsert(key, Empty, true) == nil {
+		tree.count++
+	}
+}
+
+func (tree *Tree) Delete(key []byte) {
+	tree.DeleteReturning(key)
+}
+
+func (tree *Tree) DeleteReturning(key []byte) (interface{}, bool) {
+	if tree.recorder != nil {
+		tree.recorder.record(OpDelete, key, nil)
+	}
+	if len(key) == 0 {
+		old := tree.emptyKeyValue
+		if old == nil {
+			return nil, false
+		}
+		tree.emptyKeyValue = nil
+		tree.count--
+		return userValue(old), true
+	}
+	old := tree.children.delete(tree.cow, key)
+	if old == nil {
+		return nil, false
+	}
+	tree.count--
+	return userValue(old), true
+}
+
+// DeleteMany deletes keys in one sorted pass,keys sharing a path are removed
+// in a single descent and the freed nodes go back to the FreeList under one
+// lock. duplicate and absent keys are ignored,returns the count deleted
+func (tree *Tree) DeleteMany(keys [][]byte) int {
+	sorted := append(make([][]byte, 0, len(keys)), keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	unique := sorted[:0]
+	for _, key := range sorted {
+		if len(unique) != 0 && bytes.Equal(unique[len(unique)-1], key) {
+			continue
+		}
+		unique = append(unique, key)
+	}
+	if tree.recorder != nil {
+		for _, key := range unique {
+			tree.recorder.record(OpDelete, key, nil)
+		}
+	}
+	var count int
+	if len(unique) != 0 && len(unique[0]) == 0 {
+		if tree.emptyKeyValue != nil {
+			tree.emptyKeyValue = nil
+			count++
+		}
+		unique = unique[1:]
+	}
+	var freed []*node
+	count += tree.children.deleteSorted(tree.cow, unique, 0, &freed)
+	tree.cow.freelist.freeNodes(freed)
+	tree.count -= count
+	return count
+}
+
+func (tree *Tree) DeletePrefix(prefix []byte) int {
+	if tree.recorder != nil {
+		tree.recorder.record(OpDeletePrefix, prefix, nil)
+	}
+	var count int
+	if len(prefix) == 0 {
+		count = tree.count
+		tree.clear()
+		return count
+	} else if n, _ := tree.children.prefixNode(prefix); n != nil {
+		count = tree.children.deletePrefix(tree.cow, prefix)
+	}
+	tree.count -= count
+	return count
+}
+
+// DeleteRange deletes the keys in [from, to) and returns the count deleted,
+// subtrees inside the range are freed whole without visiting their keys
+func (tree *Tree) DeleteRange(from, to []byte) int {
+	if tree.recorder != nil {
+		tree.recorder.record(OpDeleteRange, from, bytesCopy(to))
+	}
+	if bytes.Compare(from, to) >= 0 {
+		return 0
+	}
+	var count int
+	if len(from) == 0 && tree.emptyKeyValue != nil {
+		tree.emptyKeyValue = nil
+		count++
+	}
+	count += tree.children.deleteRange(tree.cow, from, to, true)
+	tree.count -= count
+	return count
+}
+
+type deleteValue struct{}
+
+// DeleteValue returned by a MapValues func deletes the key
+var DeleteValue interface{} = deleteValue{}
+
+// MapValues replaces every value with f's result,copying shared nodes so a
+// Clone is unaffected. keys mapped to DeleteValue are deleted and a nil result
+// is kept as Set keeps it,a recording logs each key as the replace, set or
+// delete it turned into
+func (tree *Tree) MapValues(f func(key []byte, old interface{}) interface{}) {
+	mapValue := f
+	f = func(key []byte, old interface{}) interface{} {
+		value := mapValue(key, userValue(old))
+		if _, ok := value.(deleteValue); ok {
+			if tree.recorder != nil {
+				tree.recorder.record(OpDelete, key, nil)
+			}
+			return nil
+		}
+		if tree.recorder != nil {
+			if value == nil {
+				tree.recorder.record(OpSet, key, nil)
+			} else {
+				tree.recorder.record(OpReplaceOrInsert, key, value)
+			}
+		}
+		return storedValue(value)
+	}
+	if tree.emptyKeyValue != nil {
+		if tree.emptyKeyValue = f([]byte{}, tree.emptyKeyValue); tree.emptyKeyValue == nil {
+			tree.count--
+		}
+	}
+	tree.count -= tree.children.mapValues(tree.cow, make([]byte, 0, 64), f)
+}
+
+// TruncateHead keeps the n smallest keys and returns the count deleted
+func (tree *Tree) TruncateHead(n int) int {
+	if tree.recorder != nil {
+		tree.recorder.record(OpTruncateHead, nil, n)
+	}
+	if n >= tree.count {
+		return 0
+	}
+	if n <= 0 {
+		count := tree.count
+		tree.clear()
+		return count
+	}
+	if tree.emptyKeyValue != nil {
+		n--
+	}
+	deleted := tree.children.truncateHead(tree.cow, n)
+	tree.count -= deleted
+	return deleted
+}
+
+// TruncateTail keeps the n largest keys and returns the count deleted
+func (tree *Tree) TruncateTail(n int) int {
+	if tree.recorder != nil {
+		tree.recorder.record(OpTruncateTail, nil, n)
+	}
+	if n >= tree.count {
+		return 0
+	}
+	if n <= 0 {
+		count := tree.count
+		tree.clear()
+		return count
+	}
+	deleted := tree.children.truncateTail(tree.cow, n)
+	if tree.emptyKeyValue != nil {
+		tree.emptyKeyValue = nil
+		deleted++
+	}
+	tree.count -= deleted
+	return deleted
+}
+
+// Clear frees the nodes owned by this tree,nodes shared with a clone are left alone
+func (tree *Tree) Clear() {
+	if tree.recorder != nil {
+		tree.recorder.record(OpClear, nil, nil)
+	}
+	tree.clear()
+}
+
+func (tree *Tree) clear() {
+	for _, child := range tree.children {
+		tree.cow.freeTree(child)
+	}
+	tree.cow.childrenFreeList.put(tree.children)
+	tree.children = nil
+	tree.emptyKeyValue = nil
+	tree.count = 0
+}
+
+func (tree *Tree) Len() int {
+	return tree.count
+}
+
+func (tree *Tree) GhostNodeCount() int {
+	return tree.children.ghostNodeCount()
+}
+
+func (tree *Tree) Optimize() {
+	for i := 0; i < len(tree.children); {
+		child := tree.children[i]
+		c := child.optimize(tree.cow)
+		if c == nil {
+			tree.children.deleteAt(i)
+			tree.cow.freeNode(child)
+			continue
+		}
+		tree.children[i] = c
+		i++
+	}
+}
+
+func (tree Tree) Walk(f func(prefixes [][]byte, val interface{}) bool) {
+	if tree.emptyKeyValue != nil && f([][]byte{}, userValue(tree.emptyKeyValue)) == false {
+		return
+	}
+	tree.children.walk(make([][]byte, 0, 32), f)
+}
+
+func (tree *Tree) walkKey(f func(key []byte, value interface{}) bool) bool {
+	if tree.emptyKeyValue != nil && f([]byte{}, tree.emptyKeyValue) == false {
+		return false
+	}
+	return tree.children.walkKey(make([]byte, 0, 64), f)
+}
+
+// WalkKeys reuses the key buffer across calls,copy it if retained
+func (tree *Tree) WalkKeys(f func(key []byte, value interface{}) bool) {
+	tree.walkKey(userValues(f))
+}
+
+// WriteKeys writes every key in order,sep goes between two keys and
+// terminator after the last one,so the output does not depend on the shape
+// of the tree
+func (tree *Tree) WriteKeys(w io.Writer, sep, terminator []byte) (int64, error) {
+	var size int64
+	var err error
+	var written bool
+	line := make([]byte, 0, 64)
+	write := func(data []byte) bool {
+		var n int
+		n, err = w.Write(data)
+		size += int64(n)
+		return err == nil
+	}
+	tree.walkKey(func(key []byte, _ interface{}) bool {
+		if line = line[:0]; written {
+			line = append(line, sep...)
+		}
+		written = true
+		line = append(line, key...)
+		return write(line)
+	})
+	if err == nil && written {
+		write(terminator)
+	}
+	return size, err
+}
+
+type WalkAction byte
+
+const (
+	Continue WalkAction = iota
+	SkipSubtree
+	Stop
+)
+
+func (children children) walkFunc(key []byte, f func(key []byte, value interface{}) WalkAction) bool {
 	for _, child := range children {
+		key := append(key, child.prefix...)
 		if child.value != nil {
-			if f(append(stack, child.prefix), child.value) == false {
+			switch f(key, userValue(child.value)) {
+			case Stop:
 				return false
+			case SkipSubtree:
+				continue
 			}
 		}
-		if child.children.walk(append(stack, child.prefix), f) == false {
+		if child.children.walkFunc(key, f) == false {
 			return false
 		}
 	}
 	return true
 }
 
-func (n *node) find(key []byte) bool {
-	if n.value != nil && bytes.Compare(n.prefix, key) == 0 {
+// WalkFunc is WalkKeys where f may skip the keys below the current one,
+// skipping below the empty key skips everything
+func (tree *Tree) WalkFunc(f func(key []byte, value interface{}) WalkAction) {
+	if tree.emptyKeyValue != nil {
+		if action := f([]byte{}, userValue(tree.emptyKeyValue)); action != Continue {
+			return
+		}
+	}
+	tree.children.walkFunc(make([]byte, 0, 64), f)
+}
+
+func (tree *Tree) Keys() [][]byte {
+	keys := make([][]byte, 0, tree.count)
+	tree.walkKey(func(key []byte, _ interface{}) bool {
+		keys = append(keys, bytesCopy(key))
+		return true
+	})
+	return keys
+}
+
+func (tree *Tree) Values() []interface{} {
+	values := make([]interface{}, 0, tree.count)
+	tree.walkKey(func(_ []byte, value interface{}) bool {
+		values = append(values, userValue(value))
+		return true
+	})
+	return values
+}
+
+// Merge inserts every key of other in one sorted pass,resolve picks the
+// value for keys in both trees and returning nil keeps the existing value.
+// a recording logs each key inserted with its resolved value,so the replay
+// does not call resolve
+func (tree *Tree) Merge(other *Tree, resolve func(key []byte, a, b interface{}) interface{}) {
+	keys := make([][]byte, 0, other.count)
+	values := make([]interface{}, 0, other.count)
+	other.walkKey(func(key []byte, value interface{}) bool {
+		if old, ok := tree.Get(key); ok {
+			value = resolve(key, old, userValue(value))
+		}
+		keys = append(keys, bytesCopy(key))
+		values = append(values, value)
 		return true
+	})
+	tree.BulkInsertSorted(keys, values)
+}
+
+// Intersect returns a new tree of the keys in both trees with the receiver's values
+func (tree *Tree) Intersect(other *Tree) *Tree {
+	small, large := tree, other
+	if other.count < tree.count {
+		small, large = other, tree
 	}
-	key = key[len(n.prefix):]
-	if _, child := n.children.findNode(key[0]); child == nil {
-		return false
-	} else {
-		return child.find(key)
+	var keys [][]byte
+	var values []interface{}
+	small.walkKey(func(key []byte, _ interface{}) bool {
+		if large.Has(key) {
+			// a key Set to nil reads back as nil,which BulkInsertSorted skips
+			value, _ := tree.Get(key)
+			keys = append(keys, bytesCopy(key))
+			values = append(values, storedValue(value))
+		}
+		return true
+	})
+	result := New()
+	result.BulkInsertSorted(keys, values)
+	return result
+}
+
+// Difference returns a new tree of the receiver's keys missing from other
+func (tree *Tree) Difference(other *Tree) *Tree {
+	var keys [][]byte
+	var values []interface{}
+	tree.walkKey(func(key []byte, value interface{}) bool {
+		if other.Has(key) == false {
+			keys = append(keys, bytesCopy(key))
+			values = append(values, value)
+		}
+		return true
+	})
+	result := New()
+	result.BulkInsertSorted(keys, values)
+	return result
+}
+
+// FilterInto returns a new tree of the keys pred accepts,the source is untouched
+func (tree *Tree) FilterInto(pred func(key []byte, value interface{}) bool) *Tree {
+	var keys [][]byte
+	var values []interface{}
+	tree.walkKey(func(key []byte, value interface{}) bool {
+		if pred(key, userValue(value)) {
+			keys = append(keys, bytesCopy(key))
+			values = append(values, value)
+		}
+		return true
+	})
+	result := New()
+	result.BulkInsertSorted(keys, values)
+	return result
+}
+
+func (tree *Tree) ToMap() map[string]interface{} {
+	m := make(map[string]interface{}, tree.count)
+	tree.walkKey(func(key []byte, value interface{}) bool {
+		m[string(key)] = userValue(value)
+		return true
+	})
+	return m
+}
+
+// FromMap builds a tree of the map,nil values are stored as by Set so ToMap
+// gives the map back
+func FromMap(m map[string]interface{}) *Tree {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := make([][]byte, len(names))
+	values := make([]interface{}, len(names))
+	for i, name := range names {
+		keys[i], values[i] = []byte(name), storedValue(m[name])
 	}
+	tree := New()
+	tree.BulkInsertSorted(keys, values)
+	return tree
 }
 
-func (tree *Tree) Find(key []byte) bool {
-	if tree.children == nil || len(key) == 0 {
-		return false
+// WalkBFS visits nodes level by level,including nodes without a value (value is nil).
+// top-level nodes have depth 1,a negative maxDepth means unlimited
+func (tree *Tree) WalkBFS(maxDepth int, f func(key []byte, value interface{}, depth int) bool) {
+	type queueItem struct {
+		node  *node
+		key   []byte
+		depth int
 	}
-	if _, child := tree.children.findNode(key[0]); child == nil {
-		return false
-	} else {
-		return child.find(key)
+	if tree.emptyKeyValue != nil && f([]byte{}, userValue(tree.emptyKeyValue), 0) == false {
+		return
+	}
+	var queue []queueItem
+	for _, child := range tree.children {
+		queue = append(queue, queueItem{node: child, key: bytesCopy(child.prefix), depth: 1})
+	}
+	for len(queue) != 0 {
+		item := queue[0]
+		queue = queue[1:]
+		if maxDepth >= 0 && item.depth > maxDepth {
+			return
+		}
+		if f(item.key, userValue(item.node.value), item.depth) == false {
+			return
+		}
+		for _, child := range item.node.children {
+			key := append(item.key[:len(item.key):len(item.key)], child.prefix...)
+			queue = append(queue, queueItem{node: child, key: key, depth: item.depth + 1})
+		}
 	}
 }
 
-func bytesCopy(data []byte) []byte {
-	out := make([]byte, len(data))
-	copy(out, data)
-	return out
+const walkContextInterval = 1 << 8
+
+func (tree *Tree) WalkContext(ctx context.Context, f func(key []byte, value interface{}) error) error {
+	var visited int
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	tree.walkKey(func(key []byte, value interface{}) bool {
+		if visited++; visited%walkContextInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		err = f(key, userValue(value))
+		return err == nil
+	})
+	return err
 }
 
-func (tree *Tree) ReplaceOrInsert(key []byte, val interface{}) interface{} {
-	if len(key) == 0 || val == nil {
-		return nil
+func (tree *Tree) Extensions(key []byte, f func(fullKey []byte, value interface{}) bool) {
+	f = userValues(f)
+	if len(key) == 0 {
+		tree.walkKey(f)
+		return
 	}
-	index, child := tree.children.findNode(key[0])
-	if child == nil {
-		tree.children.insetAt(newRNode(tree.cow, key, val), index)
-	} else {
-		return tree.children.mutableChild(tree.cow, index).replaceOrInsert(key, val)
+	n, nodeKey := tree.children.prefixNode(key)
+	if n == nil {
+		return
 	}
-	return nil
+	children{n}.walkKey(nodeKey[:len(nodeKey)-len(n.prefix)], f)
 }
 
-var Empty = []byte{'e', 'm', 'p', 't', 'y'}
-
-func (tree *Tree) Insert(key []byte) {
-	if len(key) == 0 {
+// WalkPrefixStripped walks the keys under prefix with prefix removed,a
+// prefix ending mid-edge leaves the rest of that edge on the first key
+func (tree *Tree) WalkPrefixStripped(prefix []byte, f func(relKey []byte, value interface{}) bool) {
+	f = userValues(f)
+	if len(prefix) == 0 {
+		tree.walkKey(f)
 		return
 	}
-	index, child := tree.children.findNode(key[0])
-	if child == nil {
-		tree.children.insetAt(newRNode(tree.cow, key, Empty), index)
-	} else {
-		tree.children.mutableChild(tree.cow, index).replaceOrInsert(key, Empty)
+	n, nodeKey := tree.children.prefixNode(prefix)
+	if n == nil {
+		return
+	}
+	relKey := nodeKey[len(prefix):]
+	if n.value != nil && f(relKey, n.value) == false {
+		return
 	}
+	n.children.walkKey(relKey, f)
 }
 
-func (tree *Tree) Delete(key []byte) {
-	tree.children.delete(tree.cow, key)
+func (tree *Tree) WalkTransformed(transform func([]byte) []byte, f func(key []byte, value interface{}) bool) {
+	tree.walkKey(func(key []byte, value interface{}) bool {
+		return f(transform(key), userValue(value))
+	})
 }
 
-func (tree Tree) Walk(f func(prefixes [][]byte, val interface{}) bool) {
-	tree.children.walk(make([][]byte, 0, 32), f)
+func (tree *Tree) WalkPrefix(prefix []byte, f func(prefixes [][]byte, value interface{}) bool) {
+	if len(prefix) == 0 {
+		tree.Walk(f)
+		return
+	}
+	stack := make([][]byte, 0, 32)
+	children := tree.children
+	for {
+		_, child := children.findNode(prefix[0])
+		if child == nil {
+			return
+		}
+		size := prefixLen(child.prefix, prefix)
+		if size == len(prefix) {
+			children = []*node{child}
+			break
+		}
+		if size < len(child.prefix) {
+			return
+		}
+		stack = append(stack, child.prefix)
+		children = child.children
+		prefix = prefix[size:]
+	}
+	children.walk(stack, f)
 }
 
 func (tree Tree) WalkWithPrefix(prefix []byte, f func(prefixes [][]byte, val interface{}) bool) {
@@ -273,6 +1956,91 @@ func (tree Tree) WalkWithPrefix(prefix []byte, f func(prefixes [][]byte, val int
 	}
 }
 
+func (tree *Tree) WalkRangeBounds(lo []byte, loInc bool, hi []byte, hiInc bool,
+	f func(key []byte, value interface{}) bool) {
+	f = userValues(f)
+	if tree.emptyKeyValue != nil && (lo == nil || (len(lo) == 0 && loInc)) && (len(hi) != 0 || hi == nil || hiInc) {
+		if f([]byte{}, tree.emptyKeyValue) == false {
+			return
+		}
+	}
+	tree.children.walkRange(make([]byte, 0, 64), lo, loInc, hi, hiInc, f)
+}
+
+// WalkFrom walks ascending from the smallest key >= start
+func (tree *Tree) WalkFrom(start []byte, f func(key []byte, value interface{}) bool) {
+	f = userValues(f)
+	if len(start) == 0 {
+		tree.walkKey(f)
+		return
+	}
+	tree.children.walkFrom(make([]byte, 0, 64), start, f)
+}
+
+func (tree *Tree) AnyPrefix(prefix []byte, pred func(value interface{}) bool) bool {
+	userPred := pred
+	pred = func(value interface{}) bool {
+		return userPred(userValue(value))
+	}
+	if len(prefix) == 0 {
+		if tree.emptyKeyValue != nil && pred(tree.emptyKeyValue) {
+			return true
+		}
+		return tree.children.any(pred)
+	}
+	n, _ := tree.children.prefixNode(prefix)
+	if n == nil {
+		return false
+	}
+	return children{n}.any(pred)
+}
+
+func (tree *Tree) WalkSiblingGroups(f func(parentKey []byte, firstBytes []byte, values []interface{}) bool) {
+	if len(tree.children) == 0 {
+		return
+	}
+	tree.children.walkSiblingGroups(make([]byte, 0, 64), f)
+}
+
+func (tree *Tree) Alphabet() []byte {
+	var set [4]uint64
+	var stack stack
+	stack.push(tree.children...)
+	for n := stack.pop(); n != nil; n = stack.pop() {
+		for _, b := range n.prefix {
+			set[b>>6] |= 1 << (b & 63)
+		}
+		stack.push(n.children...)
+	}
+	var alphabet []byte
+	for i := 0; i < 256; i++ {
+		if set[i>>6]&(1<<(uint(i)&63)) != 0 {
+			alphabet = append(alphabet, byte(i))
+		}
+	}
+	return alphabet
+}
+
+func (tree *Tree) AscendRange(from, to []byte, f func(key []byte, value interface{}) bool) {
+	tree.WalkRangeBounds(from, true, to, false, f)
+}
+
+// DescendRange visits keys in (to, from] in descending order,the empty key
+// comes last and only when to is nil
+func (tree *Tree) DescendRange(from, to []byte, f func(key []byte, value interface{}) bool) {
+	f = userValues(f)
+	if tree.children.descendRange(make([]byte, 0, 64), from, to, f) && to == nil && tree.emptyKeyValue != nil {
+		f([]byte{}, tree.emptyKeyValue)
+	}
+}
+
+func (tree *Tree) WalkReverse(f func(key []byte, value interface{}) bool) {
+	f = userValues(f)
+	if tree.children.descendRange(make([]byte, 0, 64), nil, nil, f) && tree.emptyKeyValue != nil {
+		f([]byte{}, tree.emptyKeyValue)
+	}
+}
+
 func prefixLen(k1, k2 []byte) int {
 	max := len(k1)
 	if l := len(k2); l < max {
@@ -295,12 +2063,12 @@ func (n *node) mutableFor(cow *copyOnWriteContext) *node {
 	if cap(out.children) >= len(n.children) {
 		out.children = out.children[:len(n.children)]
 	} else {
-		out.children = make(children, len(n.children), cap(n.children))
+		out.children = cow.childrenFreeList.get(cap(n.children))[:len(n.children)]
 	}
 	if len(out.children) > 0 {
 		copy(out.children, n.children)
 	}
-	out.prefix = bytesCopy(n.prefix)
+	out.prefix = cow.copyBytes(n.prefix)
 	out.value = n.value
 	return out
 }
@@ -319,14 +2087,16 @@ func printTokens(bytesTokens [][]byte) {
 	fmt.Println(tokens)
 }
 
-func (n *node) replaceOrInsert(key []byte, val interface{}) interface{} {
+func (n *node) replaceOrInsert(key []byte, val interface{}, replace bool) interface{} {
 	if bytes.Compare(n.prefix, key) == 0 {
 		if n.value == nil {
 			n.value = val
 			return nil
 		}
 		old := n.value
-		n.value = val
+		if replace {
+			n.value = val
+		}
 		return old
 	}
 	index := prefixLen(n.prefix, key)
@@ -334,21 +2104,23 @@ func (n *node) replaceOrInsert(key []byte, val interface{}) interface{} {
 		key = key[index:]
 		index, child := n.children.findNode(key[0])
 		if child == nil {
-			n.children.insetAt(newRNode(n.cow, bytesCopy(key), val), index)
+			n.cow.insetAt(&n.children, newRNode(n.cow, n.cow.copyBytes(key), val), index)
 		} else {
-			return n.mutableChild(index).replaceOrInsert(key, val)
+			return n.mutableChild(index).replaceOrInsert(key, val, replace)
 		}
 	} else {
-		child := *n
+		child := n.cow.newNode()
 		child.prefix = n.prefix[index:]
+		child.value = n.value
+		child.children = n.children
 		n.value = nil
 		n.prefix = n.prefix[:index]
-		n.children = make(children, 1, 2)
-		n.children[0] = &child
+		n.children = n.cow.childrenFreeList.get(2)[:1]
+		n.children[0] = child
 		key = key[index:]
 		if len(key) > 0 {
 			index, _ := n.children.findNode(key[0])
-			n.children.insetAt(newRNode(n.cow, bytesCopy(key), val), index)
+			n.cow.insetAt(&n.children, newRNode(n.cow, n.cow.copyBytes(key), val), index)
 		} else {
 			n.value = val
 		}
@@ -357,14 +2129,62 @@ func (n *node) replaceOrInsert(key []byte, val interface{}) interface{} {
 }
 
 func (n *node) merge() {
-	prefix := make([]byte, len(n.prefix)+len(n.children[0].prefix))
-	n.value = n.children[0].value
+	child := n.children[0]
+	prefix := n.cow.makeBytes(len(n.prefix) + len(child.prefix))
+	n.value = child.value
 	copy(prefix, n.prefix)
-	copy(prefix[len(n.prefix):], n.children[0].prefix)
+	copy(prefix[len(n.prefix):], child.prefix)
 	n.prefix = prefix
 	old := n.children
-	n.children = n.children[0].children
+	if child.cow == n.cow {
+		n.children = child.children
+		child.children = nil
+		n.cow.freeNode(child)
+	} else {
+		n.children = n.cow.childrenFreeList.get(len(child.children))[:len(child.children)]
+		copy(n.children, child.children)
+	}
 	old[0] = nil
+	n.cow.childrenFreeList.put(old)
+}
+
+func (n *node) optimize(cow *copyOnWriteContext) *node {
+	out := n
+	for i := 0; i < len(out.children); {
+		child := out.children[i]
+		c := child.optimize(cow)
+		if c == child {
+			i++
+			continue
+		}
+		out = out.mutableFor(cow)
+		if c == nil {
+			out.children.deleteAt(i)
+			cow.freeNode(child)
+			continue
+		}
+		out.children[i] = c
+		i++
+	}
+	if out.value == nil && len(out.children) <= 1 {
+		if len(out.children) == 0 {
+			return nil
+		}
+		out = out.mutableFor(cow)
+		out.merge()
+	}
+	return out
+}
+
+func (children children) ghostNodeCount() int {
+	var count int
+	for _, child := range children {
+		if child.value == nil && len(child.children) == 1 {
+			count++
+		}
+		count += child.children.ghostNodeCount()
+	}
+	return count
 }
 
 func (n *node) findNode(b byte) (int, *node) {
@@ -377,29 +2197,29 @@ type stackItem struct {
 }
 
 type stack struct {
-	stack []*stackItem
+	stack []stackItem
 }
 
 func (s *stack) peek() *stackItem {
 	if len(s.stack) == 0 {
 		return nil
 	}
-	rNode := s.stack[len(s.stack)-1]
-	return rNode
+	return &s.stack[len(s.stack)-1]
 }
 
-func (s *stack) pop() *stackItem {
+func (s *stack) pop() *node {
 	if len(s.stack) == 0 {
 		return nil
 	}
-	rNode := s.stack[len(s.stack)-1]
+	n := s.stack[len(s.stack)-1].node
+	s.stack[len(s.stack)-1] = stackItem{}
 	s.stack = s.stack[:len(s.stack)-1]
-	return rNode
+	return n
 }
 
 func (s *stack) push(children ...*node) {
 	for i := len(children) - 1; i >= 0; i-- {
-		s.stack = append(s.stack, &stackItem{node: children[i]})
+		s.stack = append(s.stack, stackItem{node: children[i]})
 	}
 }
 
@@ -407,64 +2227,150 @@ const (
 	PushKey = '='
 	Push    = '+'
 	Pop     = '-'
+	// PushMember is a key holding Empty,written without a value
+	PushMember = '*'
+	// PushNil is a key holding a nil stored by Set
+	PushNil = '_'
+	// PushChain is a run of value-less single-child nodes,their prefixes
+	// concatenated and then their uvarint lengths. one Pop closes the run
+	PushChain = '>'
+	// Checksum ends the stream with a big-endian crc32 of the records before it
+	Checksum = '#'
 )
 
 func (tree *Tree) WriteToWithGzip(writer io.Writer, marshaler func(interface{}) ([]byte, error)) (int64, error) {
-	gzipWriter := gzip.NewWriter(writer)
-	n, err := tree.WriteTo(gzipWriter, marshaler)
+	return tree.WriteToCompressed(writer, func(writer io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(writer), nil
+	}, marshaler)
+}
+
+func (tree *Tree) WriteToWithGzipLevel(writer io.Writer, level int, marshaler func(interface{}) ([]byte, error)) (int64, error) {
+	return tree.WriteToCompressed(writer, func(writer io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(writer, level)
+	}, marshaler)
+}
+
+func (tree *Tree) WriteToCompressed(writer io.Writer, newWriter func(io.Writer) (io.WriteCloser, error),
+	marshaler func(interface{}) ([]byte, error)) (n int64, err error) {
+	compressor, err := newWriter(writer)
 	if err != nil {
 		return 0, err
 	}
-	if err := gzipWriter.Flush(); err != nil {
-		return 0, err
-	}
-	if err := gzipWriter.Close(); err != nil {
+	// close the compressor on failure too,keeping the first error
+	defer func() {
+		if closeErr := compressor.Close(); err == nil && closeErr != nil {
+			n, err = 0, closeErr
+		}
+	}()
+	if n, err = tree.WriteTo(compressor, marshaler); err != nil {
 		return 0, err
 	}
 	return n, nil
 }
 
+// encodePush appends the push record of a node to buffer
+func encodePush(buffer *bytes.Buffer, prefix []byte, value interface{}, marshaler func(interface{}) ([]byte, error)) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	member := IsEmpty(value)
+	_, null := value.(nilValue)
+	if member {
+		buffer.WriteByte(PushMember)
+	} else if null {
+		buffer.WriteByte(PushNil)
+	} else if value != nil {
+		buffer.WriteByte(PushKey)
+	} else {
+		buffer.WriteByte(Push)
+	}
+
+	//write prefix
+	n := binary.PutVarint(lenBuf[:], int64(len(prefix)))
+	buffer.Write(lenBuf[:n])
+	buffer.Write(prefix)
+
+	//write val
+	if value != nil && member == false && null == false {
+		data, err := marshaler(value)
+		if err != nil {
+			return err
+		}
+		n := binary.PutVarint(lenBuf[:], int64(len(data)))
+		buffer.Write(lenBuf[:n])
+		buffer.Write(data)
+	}
+	return nil
+}
+
+// encodeChain appends the PushChain record of a run of nodes to buffer
+func encodeChain(buffer *bytes.Buffer, chain []*node) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	var size int
+	for _, n := range chain {
+		size += len(n.prefix)
+	}
+	buffer.WriteByte(PushChain)
+	buffer.Write(lenBuf[:binary.PutVarint(lenBuf[:], int64(size))])
+	for _, n := range chain {
+		buffer.Write(n.prefix)
+	}
+	size = 0
+	for _, n := range chain {
+		size += binary.PutUvarint(lenBuf[:], uint64(len(n.prefix)))
+	}
+	buffer.Write(lenBuf[:binary.PutVarint(lenBuf[:], int64(size))])
+	for _, n := range chain {
+		buffer.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(n.prefix)))])
+	}
+}
+
+// chain returns the run of value-less single-child nodes from n,nil unless
+// it is long enough for a PushChain record to pay off
+func (n *node) chain() []*node {
+	if n.value != nil || len(n.children) != 1 || n.children[0].value != nil || len(n.children[0].children) != 1 {
+		return nil
+	}
+	var chain []*node
+	for ; n.value == nil && len(n.children) == 1; n = n.children[0] {
+		chain = append(chain, n)
+	}
+	return chain
+}
+
 func (tree *Tree) WriteTo(writer io.Writer, marshaler func(interface{}) ([]byte, error)) (int64, error) {
-	var size int64
 	var stack stack
 	var buffer bytes.Buffer
 	var pop = []byte{Pop}
-	var lenBuf [4]byte
+	n, err := writeStreamHeader(writer)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(n)
+	var crc checksum
+	output := writer
+	writer = io.MultiWriter(output, &crc)
 	stack.push(tree.children...)
+	if tree.emptyKeyValue != nil {
+		stack.push(&node{value: tree.emptyKeyValue})
+	}
 	for item := stack.peek(); item != nil; item = stack.peek() {
 		visit := item.visit
 		item.visit = true
 		if visit == false {
 			buffer.Reset()
-			if item.value != nil {
-				buffer.WriteByte(PushKey)
-			} else {
-				buffer.WriteByte(Push)
-			}
-
-			//write prefix
-			n := binary.PutVarint(lenBuf[:], int64(len(item.prefix)))
-			buffer.Write(lenBuf[:n])
-			buffer.Write(item.prefix)
-
-			//write val
-			if item.value != nil {
-				data, err := marshaler(item.value)
-				if err != nil {
-					return 0, err
-				}
-				n := binary.PutVarint(lenBuf[:], int64(len(data)))
-				buffer.Write(lenBuf[:n])
-				buffer.Write(data)
+			children := item.children
+			if chain := item.chain(); chain != nil {
+				encodeChain(&buffer, chain)
+				children = chain[len(chain)-1].children
+			} else if err := encodePush(&buffer, item.prefix, item.value, marshaler); err != nil {
+				return 0, err
 			}
-
 			if n, err := writer.Write(buffer.Bytes()); err != nil {
 				return 0, err
 			} else {
 				size += int64(n)
 			}
-			if item.children != nil {
-				stack.push(item.children...)
+			if children != nil {
+				stack.push(children...)
 				continue
 			}
 		}
@@ -475,11 +2381,37 @@ func (tree *Tree) WriteTo(writer io.Writer, marshaler func(interface{}) ([]byte,
 			size += int64(n)
 		}
 	}
+	if n, err := writeStreamChecksum(output, crc); err != nil {
+		return 0, err
+	} else {
+		size += int64(n)
+	}
+	return size, nil
+}
+
+// WriteToBuffered is WriteTo through a bufSize buffer,so w sees one Write
+// per full buffer instead of one per record
+func (tree *Tree) WriteToBuffered(w io.Writer, bufSize int, marshaler func(interface{}) ([]byte, error)) (int64, error) {
+	writer := bufio.NewWriterSize(w, bufSize)
+	size, err := tree.WriteTo(writer, marshaler)
+	if err != nil {
+		return 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
 	return size, nil
 }
 
 func ReBuildTreeWithGzip(reader io.Reader, unMarshal func(data []byte) (interface{}, error)) (*Tree, error) {
-	reader, err := gzip.NewReader(reader)
+	return ReBuildTreeCompressed(reader, func(reader io.Reader) (io.Reader, error) {
+		return gzip.NewReader(reader)
+	}, unMarshal)
+}
+
+func ReBuildTreeCompressed(reader io.Reader, newReader func(io.Reader) (io.Reader, error),
+	unMarshal func(data []byte) (interface{}, error)) (*Tree, error) {
+	reader, err := newReader(reader)
 	if err != nil {
 		return nil, err
 	}
@@ -487,10 +2419,34 @@ func ReBuildTreeWithGzip(reader io.Reader, unMarshal func(data []byte) (interfac
 }
 
 func ReBuildTree(reader io.Reader, unMarshal func(data []byte) (interface{}, error)) (*Tree, error) {
+	return ReBuildTreeContext(context.Background(), reader, unMarshal, nil)
+}
+
+var ReBuildProgressInterval = 1 << 12
+
+// ReBuildTreeV1 loads streams written before the header was added
+func ReBuildTreeV1(reader io.Reader, unMarshal func(data []byte) (interface{}, error)) (*Tree, error) {
+	return reBuildTree(context.Background(), newStreamReader(reader), unMarshal, nil)
+}
+
+func ReBuildTreeContext(ctx context.Context, reader io.Reader,
+	unMarshal func(data []byte) (interface{}, error), progress func(nodesBuilt int)) (*Tree, error) {
+	streamReader := newStreamReader(reader)
+	if err := streamReader.readHeader(); err != nil {
+		return nil, err
+	}
+	return reBuildTree(ctx, streamReader, unMarshal, progress)
+}
+
+func reBuildTree(ctx context.Context, streamReader *streamReader,
+	unMarshal func(data []byte) (interface{}, error), progress func(nodesBuilt int)) (*Tree, error) {
 	type OpCode struct {
 		op     byte
 		prefix []byte
 		value  interface{}
+		offset int64
+		// chain holds the prefixes of the nodes below prefix in a PushChain
+		chain [][]byte
 	}
 
 	const bufferSize = 1 << 10
@@ -499,67 +2455,85 @@ func ReBuildTree(reader io.Reader, unMarshal func(data []byte) (interface{}, err
 	var curr *children
 	var opCodesCh = make(chan []OpCode, 4<<10)
 	var opCodes = make([]OpCode, 0, bufferSize)
+	var done = make(chan struct{})
+	var nodesBuilt int
+	// emptyKey is the node of the top level empty prefix,it may not have children
+	var emptyKey *node
 	var err error
-	bufReader := bufio.NewReader(reader)
+	defer close(done)
 
-	readBytes := func() []byte {
-		var size int64
-		size, err = binary.ReadVarint(bufReader)
-		if err != nil {
-			return nil
-		}
-		prefix := make([]byte, size)
-		if _, err = io.ReadFull(bufReader, prefix); err != nil {
-			return nil
+	send := func(opCodes []OpCode) bool {
+		select {
+		case opCodesCh <- opCodes:
+			return true
+		case <-done:
+			return false
 		}
-		return prefix
 	}
 
 	go func() {
 		defer func() {
 			close(opCodesCh)
 		}()
-		var opCode [1]byte
 		for {
-			if _, err := bufReader.Read(opCode[:]); err != nil {
-				if err == io.EOF {
-					break
-				}
+			var op byte
+			var prefix, data []byte
+			offset := streamReader.offset
+			op, prefix, data, err = streamReader.next(false)
+			if err == io.EOF {
+				err = nil
+				break
 			}
-			switch opCode[0] {
+			if err != nil {
+				return
+			}
+			switch op {
 			case Pop:
 				opCodes = append(opCodes, OpCode{op: Pop})
-			case Push, PushKey:
-				prefix := readBytes()
-				if prefix == nil {
-					return
-				}
-				if opCode[0] == Push {
-					opCodes = append(opCodes, OpCode{op: Push, prefix: prefix})
-					break
-				}
-				data := readBytes()
-				if data == nil {
+			case Push:
+				opCodes = append(opCodes, OpCode{op: Push, prefix: prefix, offset: offset})
+			case PushMember:
+				opCodes = append(opCodes, OpCode{op: Push, prefix: prefix, value: Empty, offset: offset})
+			case PushNil:
+				opCodes = append(opCodes, OpCode{op: Push, prefix: prefix, value: nilValue{}, offset: offset})
+			case PushChain:
+				var segments [][]byte
+				if segments, err = chainSegments(prefix, data); err != nil {
+					err = &StreamError{Offset: offset, Err: err}
 					return
 				}
+				opCodes = append(opCodes, OpCode{op: Push, prefix: segments[0], chain: segments[1:], offset: offset})
+			case PushKey:
 				var val interface{}
 				val, err = unMarshal(data)
 				if err != nil {
 					return
 				}
-				opCodes = append(opCodes, OpCode{op: Push, prefix: prefix, value: val})
+				opCodes = append(opCodes, OpCode{op: Push, prefix: prefix, value: val, offset: offset})
 			}
 			if len(opCodes) < bufferSize {
 				continue
 			}
-			opCodesCh <- opCodes
+			if send(opCodes) == false {
+				return
+			}
 			opCodes = make([]OpCode, 0, bufferSize)
 		}
-		opCodesCh <- opCodes
+		send(opCodes)
 	}()
 	for tokens := range opCodesCh {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		for _, opCode := range tokens {
 			if opCode.op == PushKey || opCode.op == Push {
+				// only the top level empty key may have an empty prefix
+				if len(opCode.prefix) == 0 && len(stack) != 0 {
+					return nil, &StreamError{Offset: opCode.offset, Err: ErrEmptyPrefix}
+				}
+				if emptyKey != nil && len(stack) != 0 && curr == &emptyKey.children {
+					return nil, &StreamError{Offset: opCode.offset, Err: ErrEmptyPrefix}
+				}
 				if len(stack) == 0 {
 					stack = append(stack, &tree.children)
 					curr = &tree.children
@@ -570,8 +2544,29 @@ func ReBuildTree(reader io.Reader, unMarshal func(data []byte) (interface{}, err
 					return nil, fmt.Errorf("stack error")
 				}
 				next := newRNode(tree.cow, opCode.prefix, opCode.value)
-				*curr = append(*curr, next)
+				if len(opCode.prefix) == 0 && len(stack) == 1 {
+					if opCode.value == nil {
+						return nil, &StreamError{Offset: opCode.offset, Err: ErrEmptyPrefix}
+					}
+					tree.emptyKeyValue = opCode.value
+					emptyKey = next
+				} else {
+					*curr = append(*curr, next)
+				}
+				for _, segment := range opCode.chain {
+					child := newRNode(tree.cow, segment, nil)
+					next.children = append(next.children, child)
+					next = child
+					nodesBuilt++
+				}
 				curr = &next.children
+				nodesBuilt++
+				if opCode.value != nil {
+					tree.count++
+				}
+				if progress != nil && nodesBuilt%ReBuildProgressInterval == 0 {
+					progress(nodesBuilt)
+				}
 			} else if opCode.op == Pop {
 				if len(stack) == 0 {
 					return nil, fmt.Errorf("stack error")
@@ -589,5 +2584,8 @@ func ReBuildTree(reader io.Reader, unMarshal func(data []byte) (interface{}, err
 	if len(stack) != 0 {
 		return nil, fmt.Errorf("broken stack")
 	}
+	if progress != nil {
+		progress(nodesBuilt)
+	}
 	return tree, nil
 }
@@ -3,15 +3,24 @@ package rtree
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/google/btree"
 	"github.com/shirou/gopsutil/process"
+	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"runtime"
 	sort "sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -93,6 +102,18 @@ func TestChildrenDelete(t *testing.T) {
 				"ac",
 			},
 		},
+		{
+			keys: []string{
+				"a",
+				"ab",
+				"abc",
+				"abd",
+				"abe",
+				"ac",
+				"acd",
+				"ad",
+			},
+		},
 	}
 
 	for _, Case := range cases {
@@ -109,6 +130,9 @@ func TestChildrenDelete(t *testing.T) {
 		for _, val := range Case.keys {
 			fmt.Println("delete", val)
 			tree.Delete([]byte(val))
+			if err := tree.Validate(); err != nil {
+				t.Errorf("delete %s: %v", val, err)
+			}
 		}
 		tree.Walk(func(prefixes [][]byte, obj interface{}) bool {
 			printTokens(prefixes)
@@ -507,3 +531,4758 @@ func BenchmarkAppend(b *testing.B) {
 		buffer = append(buffer, data...)
 	}
 }
+
+func TestWarmFreeList(t *testing.T) {
+	tree := New()
+	tree.WarmFreeList(64)
+	freelist := tree.cow.freelist
+	if len(freelist.nodes) != 64 {
+		t.Fatalf("freelist size %d", len(freelist.nodes))
+	}
+	pooled := make(map[*node]bool)
+	for _, n := range freelist.nodes {
+		pooled[n] = true
+	}
+	keys := []string{
+		"aaa",
+		"aab",
+		"aabc",
+		"abc",
+		"b",
+		"bcd",
+		"bce",
+	}
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	var count int
+	var stack stack
+	stack.push(tree.children...)
+	for n := stack.pop(); n != nil; n = stack.pop() {
+		if pooled[n] == false {
+			t.Errorf("node %s not from freelist", n.prefix)
+		}
+		count++
+		stack.push(n.children...)
+	}
+	if len(freelist.nodes) != 64-count {
+		t.Errorf("freelist size %d,expect %d", len(freelist.nodes), 64-count)
+	}
+}
+
+func streamHeader() *bytes.Buffer {
+	var buffer bytes.Buffer
+	writeStreamHeader(&buffer)
+	return &buffer
+}
+
+func sealStream(buffer *bytes.Buffer) {
+	var crc checksum
+	crc.Write(buffer.Bytes()[streamHeader().Len():])
+	writeStreamChecksum(buffer, crc)
+}
+
+func writeStreamNode(buffer *bytes.Buffer, prefix string, value []byte) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	if value != nil {
+		buffer.WriteByte(PushKey)
+	} else {
+		buffer.WriteByte(Push)
+	}
+	buffer.Write(lenBuf[:binary.PutVarint(lenBuf[:], int64(len(prefix)))])
+	buffer.WriteString(prefix)
+	if value != nil {
+		buffer.Write(lenBuf[:binary.PutVarint(lenBuf[:], int64(len(value)))])
+		buffer.Write(value)
+	}
+}
+
+func TestGhostNodeCount(t *testing.T) {
+	// a -> b -> (cd, de) with "a" and "ab" value-less single-child nodes
+	var buffer bytes.Buffer
+	writeStreamHeader(&buffer)
+	writeStreamNode(&buffer, "a", nil)
+	writeStreamNode(&buffer, "b", nil)
+	writeStreamNode(&buffer, "cd", Empty)
+	buffer.WriteByte(Pop)
+	writeStreamNode(&buffer, "de", Empty)
+	buffer.WriteByte(Pop)
+	buffer.WriteByte(Pop)
+	buffer.WriteByte(Pop)
+	writeStreamNode(&buffer, "x", nil)
+	writeStreamNode(&buffer, "y", Empty)
+	buffer.WriteByte(Pop)
+	buffer.WriteByte(Pop)
+	sealStream(&buffer)
+
+	tree, err := ReBuildTree(&buffer, func(data []byte) (interface{}, error) {
+		return data, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := tree.GhostNodeCount(); count != 2 {
+		t.Fatalf("ghost node count %d", count)
+	}
+	clone := tree.Clone()
+	tree.Optimize()
+	if count := tree.GhostNodeCount(); count != 0 {
+		t.Fatalf("ghost node count %d after Optimize", count)
+	}
+	if count := clone.GhostNodeCount(); count != 2 {
+		t.Fatalf("clone ghost node count %d after Optimize", count)
+	}
+	for _, key := range []string{"abcd", "abde", "xy"} {
+		if tree.Find([]byte(key)) == false {
+			t.Errorf("no find value:%s", key)
+		}
+		if clone.Find([]byte(key)) == false {
+			t.Errorf("clone no find value:%s", key)
+		}
+	}
+
+	tree = New()
+	for _, key := range []string{"aaa", "aaabbb", "aaaccc", "aaacccbbb", "aaacccddd"} {
+		tree.Insert([]byte(key))
+	}
+	for _, key := range []string{"aaa", "aaaccc", "aaacccbbb", "aaabbb"} {
+		tree.Delete([]byte(key))
+		if count := tree.GhostNodeCount(); count != 0 {
+			t.Errorf("ghost node count %d after delete %s", count, key)
+		}
+	}
+}
+
+func TestWalkRangeBounds(t *testing.T) {
+	inserts := []string{
+		"a",
+		"ab",
+		"abc",
+		"abd",
+		"b",
+		"ba",
+		"bab",
+		"c",
+	}
+	cases := []struct {
+		lo     []byte
+		loInc  bool
+		hi     []byte
+		hiInc  bool
+		expect []string
+	}{
+		{lo: []byte("ab"), loInc: true, hi: []byte("ba"), hiInc: false,
+			expect: []string{"ab", "abc", "abd", "b"}},
+		{lo: []byte("ab"), loInc: true, hi: []byte("ba"), hiInc: true,
+			expect: []string{"ab", "abc", "abd", "b", "ba"}},
+		{lo: []byte("ab"), loInc: false, hi: []byte("ba"), hiInc: false,
+			expect: []string{"abc", "abd", "b"}},
+		{lo: []byte("ab"), loInc: false, hi: []byte("ba"), hiInc: true,
+			expect: []string{"abc", "abd", "b", "ba"}},
+		{lo: nil, hi: []byte("abc"), hiInc: false,
+			expect: []string{"a", "ab"}},
+		{lo: []byte("abd"), loInc: false, hi: nil,
+			expect: []string{"b", "ba", "bab", "c"}},
+		{lo: []byte("aa"), loInc: true, hi: []byte("bb"), hiInc: true,
+			expect: []string{"ab", "abc", "abd", "b", "ba", "bab"}},
+		{lo: nil, hi: nil,
+			expect: inserts},
+		{lo: []byte("b"), loInc: true, hi: []byte("b"), hiInc: false,
+			expect: nil},
+	}
+	tree := New()
+	for _, key := range inserts {
+		tree.Insert([]byte(key))
+	}
+	for _, Case := range cases {
+		var result []string
+		tree.WalkRangeBounds(Case.lo, Case.loInc, Case.hi, Case.hiInc, func(key []byte, value interface{}) bool {
+			result = append(result, string(key))
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("no match %s %v %s %v\n%+v\n%+v\n",
+				Case.lo, Case.loInc, Case.hi, Case.hiInc, Case.expect, result)
+		}
+	}
+}
+
+func TestAnyPrefix(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"a", "ab", "abc", "abcd", "abce", "b"} {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	var count int
+	match := func(target string) func(value interface{}) bool {
+		return func(value interface{}) bool {
+			count++
+			return value.(string) == target
+		}
+	}
+	if tree.AnyPrefix([]byte("ab"), match("abcd")) == false {
+		t.Fatal("AnyPrefix failed")
+	}
+	if count != 3 {
+		t.Errorf("predicate called %d times", count)
+	}
+	count = 0
+	if tree.AnyPrefix([]byte("ab"), match("b")) {
+		t.Fatal("AnyPrefix matched key outside prefix")
+	}
+	if count != 4 {
+		t.Errorf("predicate called %d times", count)
+	}
+	if tree.AnyPrefix([]byte("abx"), match("abcd")) {
+		t.Fatal("AnyPrefix matched missing prefix")
+	}
+	if tree.AnyPrefix([]byte("abcdef"), match("abcd")) {
+		t.Fatal("AnyPrefix matched prefix longer than key")
+	}
+	if tree.AnyPrefix(nil, match("b")) == false {
+		t.Fatal("AnyPrefix empty prefix failed")
+	}
+}
+
+func writeToBytes(t *testing.T, tree *Tree) []byte {
+	var buffer bytes.Buffer
+	if _, err := tree.WriteTo(&buffer, func(obj interface{}) ([]byte, error) {
+		return []byte(fmt.Sprint(obj)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestRecordingReplay(t *testing.T) {
+	tree := New()
+	tree.Insert([]byte("before"))
+	tree.StartRecording()
+	tree.Insert([]byte("aaa"))
+	tree.Insert([]byte("aaabbb"))
+	tree.ReplaceOrInsert([]byte("aaaccc"), 1)
+	tree.ReplaceOrInsert([]byte("aaacccddd"), 2)
+	tree.Delete([]byte("aaa"))
+	tree.Delete([]byte("aaaccc"))
+	tree.Insert([]byte("b"))
+	ops := tree.StopRecording()
+	tree.Insert([]byte("after"))
+	if len(ops) != 7 {
+		t.Fatalf("recorded %d ops", len(ops))
+	}
+	tree.Delete([]byte("before"))
+	tree.Delete([]byte("after"))
+
+	replay := ReplayOps(ops)
+	if bytes.Compare(writeToBytes(t, tree), writeToBytes(t, replay)) != 0 {
+		t.Fatal("replayed tree not equal")
+	}
+}
+
+func TestRecordingReplayBulk(t *testing.T) {
+	for _, Case := range []struct {
+		name   string
+		mutate func(tree *Tree)
+	}{
+		{"DeletePrefix", func(tree *Tree) {
+			tree.DeletePrefix([]byte("tmp/"))
+		}},
+		{"DeleteRange", func(tree *Tree) {
+			tree.DeletePrefix([]byte("tmp/"))
+			tree.DeleteRange([]byte("x"), []byte("y"))
+			tree.DeleteRange([]byte("z"), []byte("a"))
+		}},
+		{"Truncate", func(tree *Tree) {
+			tree.TruncateHead(5)
+			tree.TruncateTail(3)
+		}},
+		{"MapValues", func(tree *Tree) {
+			tree.MapValues(func(key []byte, old interface{}) interface{} {
+				if old.(int)%2 == 0 {
+					return DeleteValue
+				}
+				if old.(int)%3 == 0 {
+					return nil
+				}
+				return old.(int) * 10
+			})
+		}},
+		{"Clear", func(tree *Tree) {
+			tree.Clear()
+			tree.Insert([]byte("after"))
+		}},
+		{"Merge", func(tree *Tree) {
+			other := New()
+			other.ReplaceOrInsert([]byte("x"), 100)
+			other.ReplaceOrInsert([]byte("new"), 200)
+			other.Set([]byte("nil"), nil)
+			tree.Merge(other, func(key []byte, a, b interface{}) interface{} {
+				return a.(int) + b.(int)
+			})
+		}},
+	} {
+		tree := New()
+		tree.StartRecording()
+		for i, key := range []string{"", "tmp/a", "tmp/b", "tmp/b/c", "x", "y", "z"} {
+			tree.ReplaceOrInsert([]byte(key), i)
+		}
+		Case.mutate(tree)
+		replay := ReplayOps(tree.StopRecording())
+		if reflect.DeepEqual(tree.ToMap(), replay.ToMap()) == false {
+			t.Errorf("%s no match \n%+v\n%+v\n", Case.name, tree.ToMap(), replay.ToMap())
+		}
+	}
+
+	// Merge is logged as the upserts it resolved to
+	tree, other := New(), New()
+	tree.ReplaceOrInsert([]byte("a"), 1)
+	other.ReplaceOrInsert([]byte("a"), 2)
+	other.Set([]byte("b"), nil)
+	tree.StartRecording()
+	tree.Merge(other, func(key []byte, a, b interface{}) interface{} {
+		return a.(int) + b.(int)
+	})
+	expect := []Op{{Type: OpReplaceOrInsert, Key: []byte("a"), Value: 3}, {Type: OpSet, Key: []byte("b")}}
+	if ops := tree.StopRecording(); reflect.DeepEqual(expect, ops) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, ops)
+	}
+}
+
+func TestWalkSiblingGroups(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"x", "xa1", "xb2", "xc3", "y"} {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	type group struct {
+		parent     string
+		firstBytes []byte
+		values     []interface{}
+	}
+	var result []group
+	tree.WalkSiblingGroups(func(parentKey []byte, firstBytes []byte, values []interface{}) bool {
+		result = append(result, group{string(parentKey), firstBytes, values})
+		return true
+	})
+	expect := []group{
+		{"", []byte{'x', 'y'}, []interface{}{"x", "y"}},
+		{"x", []byte{'a', 'b', 'c'}, []interface{}{"xa1", "xb2", "xc3"}},
+	}
+	if reflect.DeepEqual(expect, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, result)
+	}
+}
+
+func loadFilesTree(b *testing.B) *Tree {
+	f, err := os.Open("../files.txt")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(bufio.NewReader(f))
+	var tree = New()
+	for scanner.Scan() {
+		if text := scanner.Bytes(); len(text) > 0 {
+			tree.Insert(bytesCopy(text))
+		}
+	}
+	return tree
+}
+
+/*
+heap stackItem per node
+BenchmarkWriteTo 	      10	  33532997 ns/op	 4761516 B/op	  297458 allocs/op
+inline stackItem
+BenchmarkWriteTo 	      10	  27429041 ns/op	    4659 B/op	      11 allocs/op
+*/
+func BenchmarkWriteTo(b *testing.B) {
+	tree := loadFilesTree(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tree.WriteTo(ioutil.Discard, func(obj interface{}) ([]byte, error) {
+			return obj.([]byte), nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteToBuffered(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.ReplaceOrInsert([]byte(fmt.Sprint(i*7919%10007)), i)
+	}
+	tree.ReplaceOrInsert(nil, -1)
+	marshaler := func(obj interface{}) ([]byte, error) {
+		return []byte(fmt.Sprint(obj)), nil
+	}
+	var buffer bytes.Buffer
+	size, err := tree.WriteToBuffered(&buffer, 1<<10, marshaler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := writeToBytes(t, tree); bytes.Equal(expect, buffer.Bytes()) == false || size != int64(len(expect)) {
+		t.Errorf("no match %d %d %d", len(expect), buffer.Len(), size)
+	}
+	var counter writeCounter
+	if _, err := tree.WriteToBuffered(&counter, 1<<10, marshaler); err != nil {
+		t.Fatal(err)
+	}
+	if expect := int(size)/(1<<10) + 1; counter.writes > expect {
+		t.Errorf("%d writes for %d bytes", counter.writes, size)
+	}
+}
+
+type writeCounter struct {
+	writer io.Writer
+	writes int
+}
+
+func (counter *writeCounter) Write(p []byte) (int, error) {
+	counter.writes++
+	if counter.writer == nil {
+		return len(p), nil
+	}
+	return counter.writer.Write(p)
+}
+
+/*
+BenchmarkWriteToFile         	       3	 384846531 ns/op	    594896 writes/op	    4744 B/op	      16 allocs/op
+BenchmarkWriteToBufferedFile 	      31	  38201161 ns/op	       110.0 writes/op	   70336 B/op	      18 allocs/op
+*/
+func benchmarkWriteToFile(b *testing.B, writeTo func(tree *Tree, w io.Writer) error) {
+	tree := loadFilesTree(b)
+	f, err := ioutil.TempFile(b.TempDir(), "rtree")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	counter := writeCounter{writer: f}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if err := writeTo(tree, &counter); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(counter.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriteToFile(b *testing.B) {
+	benchmarkWriteToFile(b, func(tree *Tree, w io.Writer) error {
+		_, err := tree.WriteTo(w, func(obj interface{}) ([]byte, error) {
+			return obj.([]byte), nil
+		})
+		return err
+	})
+}
+
+func BenchmarkWriteToBufferedFile(b *testing.B) {
+	benchmarkWriteToFile(b, func(tree *Tree, w io.Writer) error {
+		_, err := tree.WriteToBuffered(w, 64<<10, func(obj interface{}) ([]byte, error) {
+			return obj.([]byte), nil
+		})
+		return err
+	})
+}
+
+func TestMatcher(t *testing.T) {
+	tree := New()
+	tree.ReplaceOrInsert([]byte("ab"), "ab")
+	tree.ReplaceOrInsert([]byte("abc"), "abc")
+	tree.ReplaceOrInsert([]byte("abde"), "abde")
+	tree.Set([]byte("abdx"), nil)
+
+	type result struct {
+		value   interface{}
+		isKey   bool
+		deadEnd bool
+	}
+	cases := []struct {
+		input  string
+		expect []result
+	}{
+		{input: "abc", expect: []result{{nil, false, false}, {"ab", true, false}, {"abc", true, true}}},
+		{input: "abdx", expect: []result{{nil, false, false}, {"ab", true, false}, {nil, false, false}, {nil, true, true}}},
+		{input: "abdy", expect: []result{{nil, false, false}, {"ab", true, false}, {nil, false, false}, {nil, false, true}}},
+		{input: "ax", expect: []result{{nil, false, false}, {nil, false, true}}},
+		{input: "abcd", expect: []result{{nil, false, false}, {"ab", true, false}, {"abc", true, true}, {nil, false, true}}},
+	}
+	for _, Case := range cases {
+		matcher := tree.Matcher()
+		var results []result
+		for _, b := range []byte(Case.input) {
+			value, isKey, deadEnd := matcher.Advance(b)
+			results = append(results, result{value, isKey, deadEnd})
+		}
+		if reflect.DeepEqual(Case.expect, results) == false {
+			t.Errorf("no match %s\n%+v\n%+v\n", Case.input, Case.expect, results)
+		}
+	}
+}
+
+func treeKeys(tree *Tree) []string {
+	var keys []string
+	tree.Walk(func(prefixes [][]byte, _ interface{}) bool {
+		keys = append(keys, string(bytes.Join(prefixes, nil)))
+		return true
+	})
+	return keys
+}
+
+func TestArchive(t *testing.T) {
+	shards := map[string][]string{
+		"users":  {"alice", "bob", "bobby"},
+		"groups": {"admin", "staff"},
+		"empty":  nil,
+	}
+	trees := make(map[string]*Tree)
+	for name, keys := range shards {
+		tree := New()
+		for _, key := range keys {
+			tree.Insert([]byte(key))
+		}
+		trees[name] = tree
+	}
+	marshaler := func(obj interface{}) ([]byte, error) {
+		return obj.([]byte), nil
+	}
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	var buffer bytes.Buffer
+	if err := WriteArchive(&buffer, trees, marshaler); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+
+	result, err := ReadArchive(bytes.NewReader(data), unMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(shards) {
+		t.Fatalf("archive sections %d", len(result))
+	}
+	for name, keys := range shards {
+		if reflect.DeepEqual(treeKeys(result[name]), keys) == false {
+			t.Errorf("section %s no match\n%+v\n%+v\n", name, keys, treeKeys(result[name]))
+		}
+	}
+
+	tree, err := ReadArchiveTree(bytes.NewReader(data), "users", unMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(treeKeys(tree), shards["users"]) == false {
+		t.Errorf("section users no match %+v", treeKeys(tree))
+	}
+	if _, err := ReadArchiveTree(bytes.NewReader(data), "missing", unMarshal); err == nil {
+		t.Error("expect missing section error")
+	}
+	if _, err := ReadArchive(bytes.NewReader(data[:len(data)-3]), unMarshal); err == nil {
+		t.Error("expect truncated archive error")
+	}
+}
+
+func TestAlphabet(t *testing.T) {
+	tree := New()
+	if alphabet := tree.Alphabet(); len(alphabet) != 0 {
+		t.Fatalf("empty tree alphabet %s", alphabet)
+	}
+	for _, key := range []string{"hello", "help", "world", "zebra", "hex"} {
+		tree.Insert([]byte(key))
+	}
+	if alphabet := tree.Alphabet(); string(alphabet) != "abdehloprwxz" {
+		t.Errorf("alphabet %s", alphabet)
+	}
+}
+
+func waitGoroutines(t *testing.T, expect int) {
+	for i := 0; i < 100 && runtime.NumGoroutine() > expect; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if count := runtime.NumGoroutine(); count > expect {
+		t.Errorf("goroutine leak %d > %d", count, expect)
+	}
+}
+
+type endlessReader struct {
+	offset int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	// push and pop node "a" forever
+	record := []byte{Push, 2, 'a', Pop}
+	for i := range p {
+		p[i] = record[r.offset%len(record)]
+		r.offset++
+	}
+	return len(p), nil
+}
+
+func TestReBuildTreeContext(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1<<17; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key-%08d", i)))
+	}
+	var buffer bytes.Buffer
+	if _, err := tree.WriteTo(&buffer, func(obj interface{}) ([]byte, error) {
+		return obj.([]byte), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	data := buffer.Bytes()
+
+	var progress []int
+	if _, err := ReBuildTreeContext(context.Background(), bytes.NewReader(data), unMarshal, func(nodesBuilt int) {
+		progress = append(progress, nodesBuilt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) < 2 || progress[0] != ReBuildProgressInterval {
+		t.Errorf("progress %v", progress)
+	}
+
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	_, err := ReBuildTreeContext(ctx, io.MultiReader(streamHeader(), &endlessReader{}), unMarshal, func(nodesBuilt int) {
+		calls++
+		cancel()
+	})
+	if err != context.Canceled {
+		t.Fatalf("expect context.Canceled,got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("progress called %d times after cancel", calls)
+	}
+	waitGoroutines(t, goroutines)
+}
+
+func TestReBuildTreeStackErrorNoLeak(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	reader := io.MultiReader(streamHeader(), bytes.NewReader([]byte{Pop}), &endlessReader{})
+	if _, err := ReBuildTree(reader, func(data []byte) (interface{}, error) {
+		return data, nil
+	}); err == nil {
+		t.Fatal("expect stack error")
+	}
+	waitGoroutines(t, goroutines)
+}
+
+func TestWalkTransformed(t *testing.T) {
+	keys := []string{"abc", "abcd", "xyz"}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	var result []string
+	tree.WalkTransformed(bytes.ToUpper, func(key []byte, value interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if expect := []string{"ABC", "ABCD", "XYZ"}; reflect.DeepEqual(expect, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, result)
+	}
+	if reflect.DeepEqual(keys, treeKeys(tree)) == false {
+		t.Errorf("tree changed %+v", treeKeys(tree))
+	}
+}
+
+func TestChildrenInsetAt(t *testing.T) {
+	cases := []struct {
+		children []string
+		insert   string
+		index    int
+		expect   []string
+	}{
+		{children: nil, insert: "a", index: 0, expect: []string{"a"}},
+		{children: []string{"b", "c"}, insert: "a", index: 0, expect: []string{"a", "b", "c"}},
+		{children: []string{"a", "c"}, insert: "b", index: 1, expect: []string{"a", "b", "c"}},
+		{children: []string{"a", "b"}, insert: "c", index: 2, expect: []string{"a", "b", "c"}},
+	}
+	for _, Case := range cases {
+		var nodes children
+		for _, prefix := range Case.children {
+			nodes = append(nodes, &node{prefix: []byte(prefix)})
+		}
+		index, _ := nodes.findNode(Case.insert[0])
+		if index != Case.index {
+			t.Errorf("findNode index %d,expect %d", index, Case.index)
+		}
+		nodes.insetAt(&node{prefix: []byte(Case.insert)}, Case.index)
+		var result []string
+		for _, n := range nodes {
+			result = append(result, string(n.prefix))
+		}
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("no match \n%+v\n%+v\n", Case.expect, result)
+		}
+	}
+}
+
+func TestUniqueTailsAreSingleNodes(t *testing.T) {
+	tree := New()
+	var keys []string
+	for i := 0; i < 64; i++ {
+		sum := md5.Sum([]byte{byte(i)})
+		key := fmt.Sprintf("objects/%d/%x", i%4, sum)
+		keys = append(keys, key)
+		tree.Insert([]byte(key))
+	}
+	for _, key := range keys[:16] {
+		tree.Delete([]byte(key))
+	}
+	if count := tree.GhostNodeCount(); count != 0 {
+		t.Fatalf("ghost node count %d", count)
+	}
+	tree.Walk(func(prefixes [][]byte, _ interface{}) bool {
+		if tail := prefixes[len(prefixes)-1]; len(tail) < 24 {
+			t.Errorf("unique tail split %s", bytes.Join(prefixes, []byte("|")))
+		}
+		return true
+	})
+}
+
+func TestChainEncoding(t *testing.T) {
+	// unique tails split into one node per byte,as a stream may hold them
+	plain := streamHeader()
+	writeStreamNode(plain, "objects/", nil)
+	for i := 0; i < 16; i++ {
+		tail := fmt.Sprintf("%c%x", 'a'+i, md5.Sum([]byte{byte(i)}))
+		for j := 0; j < len(tail)-1; j++ {
+			writeStreamNode(plain, tail[j:j+1], nil)
+		}
+		writeStreamNode(plain, tail[len(tail)-1:], []byte("v"))
+		plain.Write(bytes.Repeat([]byte{Pop}, len(tail)))
+	}
+	plain.WriteByte(Pop)
+	sealStream(plain)
+	unMarshal := func(data []byte) (interface{}, error) {
+		return string(data), nil
+	}
+	tree, err := ReBuildTree(bytes.NewReader(plain.Bytes()), unMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := tree.GhostNodeCount(); count != 16*32 {
+		t.Fatalf("ghost node count %d", count)
+	}
+
+	data := writeToBytes(t, tree)
+	if len(data) >= plain.Len()*2/3 || bytes.Count(data, []byte{PushChain}) != 16 {
+		t.Errorf("chain encoding %d bytes,plain %d", len(data), plain.Len())
+	}
+	for _, rebuild := range []func() (*Tree, error){
+		func() (*Tree, error) { return ReBuildTree(bytes.NewReader(data), unMarshal) },
+		func() (*Tree, error) { return ReBuildTreeParallel(bytes.NewReader(data), unMarshal, 2) },
+	} {
+		rebuilt, err := rebuild()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(tree.ToMap(), rebuilt.ToMap()) == false || rebuilt.GhostNodeCount() != tree.GhostNodeCount() {
+			t.Errorf("no match \n%+v\n%+v\n", tree.ToMap(), rebuilt.ToMap())
+		}
+		if bytes.Equal(data, writeToBytes(t, rebuilt)) == false {
+			t.Errorf("rebuilt tree writes a different stream")
+		}
+	}
+	var keys []string
+	if err := StreamKeys(bytes.NewReader(data), unMarshal, func(key []byte, _ interface{}) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != fmt.Sprintf("%s", tree.Keys()) {
+		t.Errorf("no match \n%s\n%+v\n", tree.Keys(), keys)
+	}
+	if count, err := ValidateStream(bytes.NewReader(data)); err != nil || count != 16 {
+		t.Errorf("ValidateStream %d %v", count, err)
+	}
+
+	var buffer bytes.Buffer
+	writer, err := NewTreeWriter(tree, &buffer, func(obj interface{}) ([]byte, error) {
+		return []byte(fmt.Sprint(obj)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteSubtree(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, buffer.Bytes()) == false {
+		t.Errorf("TreeWriter no match WriteTo")
+	}
+
+	// chains whose lengths do not add up to their prefix
+	for _, record := range [][]byte{
+		{4, 'a', 'b', 4, 1, 2},
+		{4, 'a', 'b', 2, 1},
+		{4, 'a', 'b', 4, 0, 2},
+		{4, 'a', 'b', 0},
+	} {
+		broken := streamHeader()
+		offset := int64(broken.Len())
+		broken.WriteByte(PushChain)
+		broken.Write(record)
+		writeStreamNode(broken, "c", []byte("v"))
+		broken.Write([]byte{Pop, Pop})
+		sealStream(broken)
+		results := map[string]error{}
+		_, results["ReBuildTree"] = ReBuildTree(bytes.NewReader(broken.Bytes()), unMarshal)
+		_, results["ReBuildTreeParallel"] = ReBuildTreeParallel(bytes.NewReader(broken.Bytes()), unMarshal, 2)
+		_, results["ValidateStream"] = ValidateStream(bytes.NewReader(broken.Bytes()))
+		for name, err := range results {
+			var streamErr *StreamError
+			if errors.As(err, &streamErr) == false || errors.Is(err, ErrBadLength) == false || streamErr.Offset != offset {
+				t.Errorf("%s broken chain %v %v", name, record, err)
+			}
+		}
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += n
+	return n, err
+}
+
+func TestFindReader(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"abc", "abcdef", "abx", "b"} {
+		tree.Insert([]byte(key))
+	}
+	cases := []struct {
+		key    string
+		expect bool
+	}{
+		{"abc", true},
+		{"abcdef", true},
+		{"abx", true},
+		{"b", true},
+		{"ab", false},
+		{"abcd", false},
+		{"abcdefg", false},
+		{"bb", false},
+		{"c", false},
+		{"", false},
+	}
+	for _, Case := range cases {
+		found, err := tree.FindReader(bytes.NewReader([]byte(Case.key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != Case.expect {
+			t.Errorf("FindReader %s %v", Case.key, found)
+		}
+	}
+	reader := &countingReader{reader: bytes.NewReader(append([]byte("abq"), make([]byte, 1<<20)...))}
+	if found, err := tree.FindReader(reader); err != nil || found {
+		t.Fatal("FindReader long key failed")
+	}
+	if reader.count > 3 {
+		t.Errorf("FindReader read %d bytes", reader.count)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"a", "ab", "abc", "abcd", "abd", "b"} {
+		tree.Insert([]byte(key))
+	}
+	cases := []struct {
+		key    string
+		expect []string
+	}{
+		{key: "ab", expect: []string{"ab", "abc", "abcd", "abd"}},
+		{key: "abc", expect: []string{"abc", "abcd"}},
+		{key: "abcde", expect: nil},
+		{key: "x", expect: nil},
+		{key: "", expect: []string{"a", "ab", "abc", "abcd", "abd", "b"}},
+	}
+	for _, Case := range cases {
+		var result []string
+		tree.Extensions([]byte(Case.key), func(fullKey []byte, value interface{}) bool {
+			result = append(result, string(fullKey))
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("no match %s\n%+v\n%+v\n", Case.key, Case.expect, result)
+		}
+	}
+
+	tree = New()
+	tree.Insert([]byte("abcdef"))
+	var result []string
+	tree.Extensions([]byte("abc"), func(fullKey []byte, value interface{}) bool {
+		result = append(result, string(fullKey))
+		return true
+	})
+	if reflect.DeepEqual([]string{"abcdef"}, result) == false {
+		t.Errorf("mid-edge no match %+v", result)
+	}
+}
+
+/*
+make children
+BenchmarkInsertDeleteChurn 	 1773950	       655.5 ns/op	     207 B/op	       6 allocs/op
+childrenFreeList
+BenchmarkInsertDeleteChurn 	 1782964	       698.0 ns/op	     191 B/op	       5 allocs/op
+free deleted nodes
+BenchmarkInsertDeleteChurn 	 2328711	       516.7 ns/op	      31 B/op	       3 allocs/op
+*/
+func BenchmarkInsertDeleteChurn(b *testing.B) {
+	var keys [][]byte
+	for i := 0; i < 1<<12; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("churn/%03d/%05d/a", i%97, i)))
+		keys = append(keys, []byte(fmt.Sprintf("churn/%03d/%05d/b", i%97, i)))
+	}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert(key)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i%len(keys)]
+		tree.Delete(key)
+		tree.Insert(key)
+	}
+}
+
+func TestValidateStream(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"a", "ab", "abc", "b", "bcd"} {
+		tree.Insert([]byte(key))
+	}
+	data := writeToBytes(t, tree)
+	if count, err := ValidateStream(bytes.NewReader(data)); err != nil || count != 5 {
+		t.Fatalf("ValidateStream %d %v", count, err)
+	}
+
+	header := int64(streamHeader().Len())
+	body := data[:len(data)-5]
+	sealed := func(tail ...byte) []byte {
+		buffer := bytes.NewBuffer(append(append([]byte{}, body...), tail...))
+		sealStream(buffer)
+		return buffer.Bytes()
+	}
+	unbalanced := bytes.NewBuffer(append([]byte{}, body[:len(body)-1]...))
+	sealStream(unbalanced)
+	corrupted := append([]byte{}, data...)
+	corrupted[header+2]++
+	overflow := streamHeader()
+	overflow.WriteByte(Push)
+	overflow.Write([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01})
+	negative := streamHeader()
+	negative.WriteByte(Push)
+	negative.WriteByte(1)
+	cases := []struct {
+		name   string
+		data   []byte
+		err    error
+		offset int64
+	}{
+		{name: "unknown opCode", data: sealed('?'), err: ErrUnknownOpCode, offset: int64(len(body))},
+		{name: "underflow", data: sealed(Pop), err: ErrStackError, offset: int64(len(body))},
+		{name: "unbalanced", data: unbalanced.Bytes(), err: ErrBrokenStack, offset: int64(unbalanced.Len())},
+		{name: "checksum", data: corrupted, err: ErrChecksum, offset: int64(len(body))},
+		{name: "missing checksum", data: body, err: ErrNoChecksum, offset: int64(len(body))},
+		{name: "trailing data", data: append(append([]byte{}, data...), Pop), err: ErrTrailingData, offset: int64(len(body))},
+		{name: "truncated", data: data[:2], err: io.ErrUnexpectedEOF, offset: 0},
+		{name: "negative length", data: negative.Bytes(), err: ErrBadLength, offset: header},
+		{name: "overflow length", data: overflow.Bytes(), err: nil, offset: header},
+	}
+	for _, Case := range cases {
+		_, err := ValidateStream(bytes.NewReader(Case.data))
+		streamErr, ok := err.(*StreamError)
+		if ok == false {
+			t.Errorf("%s: expect StreamError,got %v", Case.name, err)
+			continue
+		}
+		if Case.err != nil && streamErr.Err != Case.err {
+			t.Errorf("%s: expect %v,got %v", Case.name, Case.err, streamErr.Err)
+		}
+		if streamErr.Offset != Case.offset {
+			t.Errorf("%s: expect offset %d,got %d", Case.name, Case.offset, streamErr.Offset)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	tree := New()
+	tree.ReplaceOrInsert([]byte("abc"), 1)
+	tree.ReplaceOrInsert([]byte("abcdef"), 2)
+	tree.ReplaceOrInsert([]byte("abx"), 3)
+	tree.Insert([]byte("set"))
+	cases := []struct {
+		key   string
+		value interface{}
+		found bool
+	}{
+		{"abc", 1, true},
+		{"abcdef", 2, true},
+		{"abx", 3, true},
+		{"set", Empty, true},
+		{"ab", nil, false},
+		{"a", nil, false},
+		{"abcd", nil, false},
+		{"abcdefg", nil, false},
+		{"abd", nil, false},
+		{"se", nil, false},
+		{"", nil, false},
+	}
+	for _, Case := range cases {
+		value, found := tree.Get([]byte(Case.key))
+		if found != Case.found || reflect.DeepEqual(value, Case.value) == false {
+			t.Errorf("Get %s: %v %v", Case.key, value, found)
+		}
+	}
+}
+
+func TestLen(t *testing.T) {
+	tree := New()
+	tree.Insert([]byte("abc"))
+	tree.Insert([]byte("abc"))
+	tree.ReplaceOrInsert([]byte("abcdef"), 1)
+	tree.ReplaceOrInsert([]byte("abcdef"), 2)
+	tree.Insert([]byte("ab"))
+	tree.Delete([]byte("a"))
+	tree.Delete([]byte("abcd"))
+	if tree.Len() != 3 {
+		t.Fatalf("Len %d", tree.Len())
+	}
+	clone := tree.Clone()
+	clone.Insert([]byte("x"))
+	tree.Delete([]byte("abc"))
+	tree.Delete([]byte("abc"))
+	if tree.Len() != 2 || clone.Len() != 4 {
+		t.Fatalf("Len %d clone Len %d", tree.Len(), clone.Len())
+	}
+	if tree.Len() != len(treeKeys(tree)) || clone.Len() != len(treeKeys(clone)) {
+		t.Fatal("Len not match Walk")
+	}
+
+	var buffer bytes.Buffer
+	if _, err := clone.WriteTo(&buffer, func(obj interface{}) ([]byte, error) {
+		return []byte(fmt.Sprint(obj)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rebuild, err := ReBuildTree(&buffer, func(data []byte) (interface{}, error) {
+		return data, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuild.Len() != 4 {
+		t.Fatalf("rebuild Len %d", rebuild.Len())
+	}
+}
+
+func TestFreeListConcurrent(t *testing.T) {
+	freelist := NewFreeList(16)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				nodes := []*node{freelist.newNode(), freelist.newNode(), freelist.newNode()}
+				for _, n := range nodes {
+					freelist.freeNode(n)
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("freelist deadlock")
+	}
+	if size := len(freelist.nodes); size == 0 || size > 16 {
+		t.Errorf("freelist size %d", size)
+	}
+}
+
+func TestDeleteFreeNodes(t *testing.T) {
+	keys := []string{"aaa", "aaabbb", "aaaccc", "aaacccbbb", "aaacccddd", "b"}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	clone := tree.Clone()
+	clone.Insert([]byte("c"))
+	for _, key := range keys {
+		tree.Delete([]byte(key))
+		if err := tree.Validate(); err != nil {
+			t.Errorf("delete %s: %v", key, err)
+		}
+	}
+	if tree.Len() != 0 || len(treeKeys(tree)) != 0 {
+		t.Errorf("tree not empty %+v", treeKeys(tree))
+	}
+	if expect := append(append([]string{}, keys...), "c"); reflect.DeepEqual(expect, treeKeys(clone)) == false {
+		t.Errorf("clone changed %+v", treeKeys(clone))
+	}
+
+	tree = clone.Clone()
+	for _, key := range keys {
+		tree.Insert([]byte(key + "x"))
+	}
+	for _, key := range keys {
+		tree.Delete([]byte(key + "x"))
+	}
+	if size := len(tree.cow.freelist.nodes); size == 0 {
+		t.Error("deleted nodes not freed")
+	}
+	if reflect.DeepEqual(treeKeys(clone), treeKeys(tree)) == false {
+		t.Errorf("no match \n%+v\n%+v\n", treeKeys(clone), treeKeys(tree))
+	}
+}
+
+func TestFindPrefixOfKey(t *testing.T) {
+	tree := New()
+	tree.Insert([]byte("abcdef"))
+	tree.Insert([]byte("abcxyz"))
+	tree.Insert([]byte("abcxyzd"))
+	cases := []struct {
+		key    string
+		expect bool
+	}{
+		{"abcdef", true},
+		{"abcxyz", true},
+		{"abcxyzd", true},
+		{"abc", false},
+		{"ab", false},
+		{"abcd", false},
+		{"abcxy", false},
+		{"abcdefg", false},
+		{"aXcxyzd", false},
+		{"abcXyzd", false},
+	}
+	for _, Case := range cases {
+		if found := tree.Find([]byte(Case.key)); found != Case.expect {
+			t.Errorf("Find %s %v", Case.key, found)
+		}
+	}
+}
+
+func TestLongestPrefix(t *testing.T) {
+	tree := New()
+	tree.ReplaceOrInsert([]byte("foo"), 1)
+	tree.ReplaceOrInsert([]byte("foobar"), 2)
+	tree.ReplaceOrInsert([]byte("foobarbaz"), 3)
+	tree.ReplaceOrInsert([]byte("fox"), 4)
+	cases := []struct {
+		key   string
+		match string
+		value interface{}
+		found bool
+	}{
+		{"foobaz", "foo", 1, true},
+		{"foobar", "foobar", 2, true},
+		{"foobarba", "foobar", 2, true},
+		{"foobarbazqux", "foobarbaz", 3, true},
+		{"foxes", "fox", 4, true},
+		{"fo", "", nil, false},
+		{"bar", "", nil, false},
+		{"", "", nil, false},
+	}
+	for _, Case := range cases {
+		match, value, found := tree.LongestPrefix([]byte(Case.key))
+		if string(match) != Case.match || value != Case.value || found != Case.found {
+			t.Errorf("LongestPrefix %s: %s %v %v", Case.key, match, value, found)
+		}
+	}
+}
+
+func TestWalkPrefix(t *testing.T) {
+	inserts := []string{
+		"aaa",
+		"aab",
+		"aabc",
+		"aabcdd",
+		"aabcddff",
+		"aabcddffgg",
+		"aabx",
+	}
+	cases := []struct {
+		prefix string
+		expect []string
+	}{
+		{prefix: "aabc", expect: []string{"aabc", "aabcdd", "aabcddff", "aabcddffgg"}},
+		{prefix: "aabcd", expect: []string{"aabcdd", "aabcddff", "aabcddffgg"}},
+		{prefix: "aabcddf", expect: []string{"aabcddff", "aabcddffgg"}},
+		{prefix: "aa", expect: inserts},
+		{prefix: "aabcdx", expect: nil},
+		{prefix: "aabcddffggg", expect: nil},
+		{prefix: "b", expect: nil},
+		{prefix: "", expect: inserts},
+	}
+	tree := New()
+	for _, key := range inserts {
+		tree.Insert([]byte(key))
+	}
+	for _, Case := range cases {
+		var result []string
+		tree.WalkPrefix([]byte(Case.prefix), func(prefixes [][]byte, value interface{}) bool {
+			result = append(result, string(bytes.Join(prefixes, nil)))
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("no match %s\n%+v\n%+v\n", Case.prefix, Case.expect, result)
+		}
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	inserts := []string{
+		"tmp",
+		"tmp/a",
+		"tmp/b/c",
+		"tmp/b/d",
+		"tmpfile",
+		"usr/bin",
+		"usr/lib",
+	}
+	cases := []struct {
+		prefix string
+		count  int
+		expect []string
+	}{
+		{prefix: "tmp/", count: 3, expect: []string{"tmp", "tmpfile", "usr/bin", "usr/lib"}},
+		{prefix: "tmp", count: 5, expect: []string{"usr/bin", "usr/lib"}},
+		{prefix: "tmp/b/", count: 2, expect: []string{"tmp", "tmp/a", "tmpfile", "usr/bin", "usr/lib"}},
+		{prefix: "usr/l", count: 1, expect: []string{"tmp", "tmp/a", "tmp/b/c", "tmp/b/d", "tmpfile", "usr/bin"}},
+		{prefix: "u", count: 2, expect: []string{"tmp", "tmp/a", "tmp/b/c", "tmp/b/d", "tmpfile"}},
+		{prefix: "usr/x", count: 0, expect: inserts},
+		{prefix: "tmp/b/cc", count: 0, expect: inserts},
+		{prefix: "", count: 7, expect: nil},
+	}
+	for _, Case := range cases {
+		tree := New()
+		for _, key := range inserts {
+			tree.Insert([]byte(key))
+		}
+		clone := tree.Clone()
+		if count := tree.DeletePrefix([]byte(Case.prefix)); count != Case.count {
+			t.Errorf("DeletePrefix %s count %d", Case.prefix, count)
+		}
+		if reflect.DeepEqual(Case.expect, treeKeys(tree)) == false {
+			t.Errorf("no match %s\n%+v\n%+v\n", Case.prefix, Case.expect, treeKeys(tree))
+		}
+		if tree.Len() != len(Case.expect) {
+			t.Errorf("Len %d", tree.Len())
+		}
+		if tree.GhostNodeCount() != 0 {
+			t.Errorf("ghost nodes after DeletePrefix %s", Case.prefix)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Errorf("DeletePrefix %s: %v", Case.prefix, err)
+		}
+		if reflect.DeepEqual(inserts, treeKeys(clone)) == false {
+			t.Errorf("clone changed %s %+v", Case.prefix, treeKeys(clone))
+		}
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	tree := New()
+	if _, _, ok := tree.Min(); ok {
+		t.Fatal("Min on empty tree")
+	}
+	if _, _, ok := tree.Max(); ok {
+		t.Fatal("Max on empty tree")
+	}
+	for i, key := range []string{"m", "abc", "abd", "zzy", "zzx", "zz"} {
+		tree.ReplaceOrInsert([]byte(key), i)
+	}
+	if key, value, ok := tree.Min(); ok == false || string(key) != "abc" || value != 1 {
+		t.Errorf("Min %s %v %v", key, value, ok)
+	}
+	if key, value, ok := tree.Max(); ok == false || string(key) != "zzy" || value != 3 {
+		t.Errorf("Max %s %v %v", key, value, ok)
+	}
+	tree.Delete([]byte("zzy"))
+	tree.Delete([]byte("zzx"))
+	tree.Insert([]byte("ab"))
+	if key, _, ok := tree.Min(); ok == false || string(key) != "ab" {
+		t.Errorf("Min %s %v", key, ok)
+	}
+	if key, value, ok := tree.Max(); ok == false || string(key) != "zz" || value != 5 {
+		t.Errorf("Max %s %v %v", key, value, ok)
+	}
+
+	// the empty key is the smallest key
+	tree = New()
+	tree.ReplaceOrInsert(nil, "empty")
+	for _, bound := range []func() ([]byte, interface{}, bool){tree.Min, tree.Max} {
+		if key, value, ok := bound(); ok == false || key == nil || len(key) != 0 || value != "empty" {
+			t.Errorf("empty key only %q %v %v", key, value, ok)
+		}
+	}
+	tree.ReplaceOrInsert([]byte("a"), "a")
+	if key, value, ok := tree.Min(); ok == false || key == nil || len(key) != 0 || value != "empty" {
+		t.Errorf("Min %q %v %v", key, value, ok)
+	}
+	if key, value, ok := tree.Max(); ok == false || string(key) != "a" || value != "a" {
+		t.Errorf("Max %q %v %v", key, value, ok)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	tree := New()
+	if tree.Iterator().Next() {
+		t.Fatal("Next on empty tree")
+	}
+	keys := []string{"b", "a", "abc", "ab", "abd", "ba", "c", "abcdef"}
+	for _, key := range keys {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	var result []string
+	for it := tree.Iterator(); it.Next(); {
+		if it.Value() != string(it.Key()) {
+			t.Errorf("value %v key %s", it.Value(), it.Key())
+		}
+		result = append(result, string(it.Key()))
+	}
+	sort.Strings(keys)
+	if reflect.DeepEqual(keys, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", keys, result)
+	}
+	if reflect.DeepEqual(treeKeys(tree), result) == false {
+		t.Errorf("no match Walk\n%+v\n%+v\n", treeKeys(tree), result)
+	}
+}
+
+func TestAscendDescendRange(t *testing.T) {
+	inserts := []string{
+		"2022-12-31",
+		"2023-01",
+		"2023-01-01",
+		"2023-01-15",
+		"2023-02",
+		"2023-02-01",
+		"2023-03-01",
+	}
+	tree := New()
+	for _, key := range inserts {
+		tree.Insert([]byte(key))
+	}
+	cases := []struct {
+		from, to string
+		ascend   []string
+	}{
+		{from: "2023-01", to: "2023-02", ascend: []string{"2023-01", "2023-01-01", "2023-01-15"}},
+		{from: "2023-01-0", to: "2023-02-0", ascend: []string{"2023-01-01", "2023-01-15", "2023-02"}},
+		{from: "2023", to: "2024", ascend: inserts[1:]},
+		{from: "2023-02", to: "2023-01", ascend: nil},
+		{from: "2023-01-15", to: "2023-01-15", ascend: nil},
+		{from: "2000", to: "3000", ascend: inserts},
+	}
+	for _, Case := range cases {
+		var result []string
+		tree.AscendRange([]byte(Case.from), []byte(Case.to), func(key []byte, value interface{}) bool {
+			result = append(result, string(key))
+			return true
+		})
+		if reflect.DeepEqual(Case.ascend, result) == false {
+			t.Errorf("AscendRange no match %s %s\n%+v\n%+v\n", Case.from, Case.to, Case.ascend, result)
+		}
+	}
+
+	var all []string
+	tree.DescendRange(nil, nil, func(key []byte, value interface{}) bool {
+		all = append(all, string(key))
+		return true
+	})
+	for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+		all[i], all[j] = all[j], all[i]
+	}
+	if reflect.DeepEqual(inserts, all) == false {
+		t.Errorf("DescendRange no match \n%+v\n%+v\n", inserts, all)
+	}
+	descends := []struct {
+		from, to string
+		expect   []string
+	}{
+		{from: "2023-02", to: "2023-01", expect: []string{"2023-02", "2023-01-15", "2023-01-01"}},
+		{from: "2023-01-2", to: "2023-01-0", expect: []string{"2023-01-15", "2023-01-01"}},
+		{from: "2023-01", to: "2023-02", expect: nil},
+		{from: "3000", to: "2023-02", expect: []string{"2023-03-01", "2023-02-01"}},
+	}
+	for _, Case := range descends {
+		var result []string
+		tree.DescendRange([]byte(Case.from), []byte(Case.to), func(key []byte, value interface{}) bool {
+			result = append(result, string(key))
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("DescendRange no match %s %s\n%+v\n%+v\n", Case.from, Case.to, Case.expect, result)
+		}
+	}
+}
+
+func TestEmptyKeyRanges(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"", "a", "b"} {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	collect := func(result *[]string) func(key []byte, value interface{}) bool {
+		return func(key []byte, value interface{}) bool {
+			*result = append(*result, string(key))
+			return true
+		}
+	}
+	bounds := []struct {
+		lo     []byte
+		loInc  bool
+		hi     []byte
+		hiInc  bool
+		expect []string
+	}{
+		{lo: nil, hi: nil, expect: []string{"", "a", "b"}},
+		{lo: []byte{}, loInc: true, hi: []byte("b"), expect: []string{"", "a"}},
+		{lo: []byte{}, loInc: false, hi: nil, expect: []string{"a", "b"}},
+		{lo: nil, hi: []byte{}, hiInc: true, expect: []string{""}},
+		{lo: nil, hi: []byte{}, hiInc: false, expect: nil},
+		{lo: []byte("a"), loInc: true, hi: nil, expect: []string{"a", "b"}},
+	}
+	for _, Case := range bounds {
+		var result []string
+		tree.WalkRangeBounds(Case.lo, Case.loInc, Case.hi, Case.hiInc, collect(&result))
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("WalkRangeBounds no match %q %v %q %v\n%+v\n%+v\n",
+				Case.lo, Case.loInc, Case.hi, Case.hiInc, Case.expect, result)
+		}
+	}
+	ranges := []struct {
+		from, to []byte
+		ascend   []string
+		descend  []string
+	}{
+		{from: nil, to: nil, ascend: []string{"", "a", "b"}, descend: []string{"b", "a", ""}},
+		{from: []byte{}, to: []byte("b"), ascend: []string{"", "a"}, descend: nil},
+		{from: []byte("a"), to: nil, ascend: []string{"a", "b"}, descend: []string{"a", ""}},
+		{from: []byte("b"), to: []byte{}, ascend: nil, descend: []string{"b", "a"}},
+	}
+	for _, Case := range ranges {
+		var ascend, descend []string
+		tree.AscendRange(Case.from, Case.to, collect(&ascend))
+		if reflect.DeepEqual(Case.ascend, ascend) == false {
+			t.Errorf("AscendRange no match %q %q\n%+v\n%+v\n", Case.from, Case.to, Case.ascend, ascend)
+		}
+		tree.DescendRange(Case.from, Case.to, collect(&descend))
+		if reflect.DeepEqual(Case.descend, descend) == false {
+			t.Errorf("DescendRange no match %q %q\n%+v\n%+v\n", Case.from, Case.to, Case.descend, descend)
+		}
+	}
+
+	var result []string
+	tree.WalkTransformed(bytes.ToUpper, collect(&result))
+	if expect := []string{"", "A", "B"}; reflect.DeepEqual(expect, result) == false {
+		t.Errorf("WalkTransformed no match \n%+v\n%+v\n", expect, result)
+	}
+	if tree.AnyPrefix(nil, func(value interface{}) bool { return value.(string) == "" }) == false {
+		t.Error("AnyPrefix missed the empty key")
+	}
+
+	snapshot := tree.Snapshot()
+	result = nil
+	snapshot.DescendRange(nil, nil, collect(&result))
+	if expect := []string{"b", "a", ""}; reflect.DeepEqual(expect, result) == false {
+		t.Errorf("Snapshot.DescendRange no match \n%+v\n%+v\n", expect, result)
+	}
+
+	fold := NewFold()
+	fold.Insert([]byte(""))
+	fold.Insert([]byte("A"))
+	result = nil
+	fold.AscendRange(nil, nil, collect(&result))
+	if expect := []string{"", "A"}; reflect.DeepEqual(expect, result) == false {
+		t.Errorf("FoldTree.AscendRange no match \n%+v\n%+v\n", expect, result)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	tree := New()
+	increment := func(old interface{}, existed bool) interface{} {
+		if existed == false {
+			return 1
+		}
+		return old.(int) + 1
+	}
+	for _, word := range strings.Fields("a b a c a b abc ab a") {
+		tree.Upsert([]byte(word), increment)
+	}
+	expect := map[string]int{"a": 4, "b": 2, "c": 1, "abc": 1, "ab": 1}
+	for word, count := range expect {
+		if value, ok := tree.Get([]byte(word)); ok == false || value != count {
+			t.Errorf("%s count %v", word, value)
+		}
+	}
+	if tree.Len() != len(expect) {
+		t.Errorf("Len %d", tree.Len())
+	}
+	if val := tree.Upsert([]byte("x"), func(old interface{}, existed bool) interface{} {
+		return nil
+	}); val != nil || tree.Find([]byte("x")) {
+		t.Error("Upsert inserted nil value")
+	}
+}
+
+func TestGetOrInsert(t *testing.T) {
+	tree := New()
+	tree.ReplaceOrInsert([]byte("abc"), 1)
+	cases := []struct {
+		key    string
+		val    interface{}
+		actual interface{}
+		loaded bool
+	}{
+		{"abc", 2, 1, true},
+		{"ab", 3, 3, false},
+		{"ab", 4, 3, true},
+		{"abcd", 5, 5, false},
+		{"x", 6, 6, false},
+		{"abc", 7, 1, true},
+	}
+	for _, Case := range cases {
+		actual, loaded := tree.GetOrInsert([]byte(Case.key), Case.val)
+		if actual != Case.actual || loaded != Case.loaded {
+			t.Errorf("GetOrInsert %s: %v %v", Case.key, actual, loaded)
+		}
+	}
+	if tree.Len() != 4 {
+		t.Errorf("Len %d", tree.Len())
+	}
+	if value, _ := tree.Get([]byte("abc")); value != 1 {
+		t.Errorf("GetOrInsert replaced value %v", value)
+	}
+}
+
+func TestDeleteReturning(t *testing.T) {
+	tree := New()
+	for i, key := range []string{"aaa", "aaabbb", "aaaccc", "aaacccbbb", "aaacccddd"} {
+		tree.ReplaceOrInsert([]byte(key), i)
+	}
+	cases := []struct {
+		key   string
+		value interface{}
+		found bool
+	}{
+		{"aa", nil, false},
+		{"aaab", nil, false},
+		{"aaax", nil, false},
+		{"aaacccbbbb", nil, false},
+		{"aaa", 0, true},
+		{"aaa", nil, false},
+		{"aaaccc", 2, true},
+		{"aaacccbbb", 3, true},
+		{"aaabbb", 1, true},
+		{"aaacccddd", 4, true},
+		{"aaacccddd", nil, false},
+	}
+	for _, Case := range cases {
+		value, found := tree.DeleteReturning([]byte(Case.key))
+		if value != Case.value || found != Case.found {
+			t.Errorf("DeleteReturning %s: %v %v", Case.key, value, found)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Errorf("DeleteReturning %s: %v", Case.key, err)
+		}
+	}
+	if tree.Len() != 0 || len(tree.children) != 0 {
+		t.Errorf("tree not empty %d", tree.Len())
+	}
+}
+
+func TestWalkRetainPrefixes(t *testing.T) {
+	keys := []string{"a", "ab", "abc", "abd", "ac", "b", "bcd", "bce"}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	var retained [][][]byte
+	tree.Walk(func(prefixes [][]byte, _ interface{}) bool {
+		retained = append(retained, prefixes)
+		return true
+	})
+	var result []string
+	for _, prefixes := range retained {
+		result = append(result, string(bytes.Join(prefixes, nil)))
+	}
+	if reflect.DeepEqual(keys, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", keys, result)
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	tree := New()
+	if tree.Find([]byte{}) {
+		t.Errorf("empty key found in empty tree")
+	}
+	tree.Insert([]byte{})
+	tree.Insert([]byte("a"))
+	if tree.Find([]byte{}) == false {
+		t.Errorf("empty key not found")
+	}
+	if tree.Len() != 2 {
+		t.Errorf("Len %d", tree.Len())
+	}
+	if old := tree.ReplaceOrInsert([]byte{}, "root"); reflect.DeepEqual(old, Empty) == false {
+		t.Errorf("ReplaceOrInsert old %v", old)
+	}
+	if value, ok := tree.Get(nil); ok == false || value != "root" {
+		t.Errorf("Get %v %v", value, ok)
+	}
+	var walked []string
+	tree.Walk(func(prefixes [][]byte, _ interface{}) bool {
+		walked = append(walked, string(bytes.Join(prefixes, nil)))
+		return true
+	})
+	if reflect.DeepEqual(walked, []string{"", "a"}) == false {
+		t.Errorf("no match \n%+v\n", walked)
+	}
+
+	marshaler := func(val interface{}) ([]byte, error) { return []byte(fmt.Sprint(val)), nil }
+	unMarshal := func(data []byte) (interface{}, error) { return string(data), nil }
+	var buffer bytes.Buffer
+	if _, err := tree.WriteTo(&buffer, marshaler); err != nil {
+		t.Fatal(err)
+	}
+	reload, err := ReBuildTree(&buffer, unMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := reload.Get([]byte{}); ok == false || value != "root" || reload.Len() != 2 {
+		t.Errorf("reload %v %v %d", value, ok, reload.Len())
+	}
+
+	if value, ok := tree.DeleteReturning([]byte{}); ok == false || value != "root" {
+		t.Errorf("DeleteReturning %v %v", value, ok)
+	}
+	if tree.Find([]byte{}) || tree.Len() != 1 {
+		t.Errorf("empty key not deleted %d", tree.Len())
+	}
+}
+
+func TestSyncTree(t *testing.T) {
+	tree := NewSyncTree()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", w, i))
+				tree.ReplaceOrInsert(key, i)
+				if i%3 == 0 {
+					tree.Delete(key)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", r, i))
+				tree.Find(key)
+				tree.Get(key)
+				if i%100 == 0 {
+					snapshot := tree.Snapshot()
+					snapshot.Walk(func(_ [][]byte, _ interface{}) bool {
+						return true
+					})
+					tree.ReadOnlySnapshot().Walk(func(_ [][]byte, _ interface{}) bool {
+						return true
+					})
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	snapshot := tree.Snapshot()
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key-%d-%d", w, i))
+			if value, ok := snapshot.Get(key); ok != (i%3 != 0) || (ok && value != i) {
+				t.Errorf("no match %s %v %v", key, value, ok)
+			}
+		}
+	}
+	if snapshot.Len() != 4*666 {
+		t.Errorf("Len %d", snapshot.Len())
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestReBuildTreeReadError(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"abc", "abcdef", "abx", "xyz"} {
+		tree.ReplaceOrInsert([]byte(key), []byte(key))
+	}
+	data := writeToBytes(t, tree)
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	for size := 1; size < len(data); size++ {
+		if rebuild, err := ReBuildTree(bytes.NewReader(data[:size]), unMarshal); err == nil || rebuild != nil {
+			t.Errorf("truncated at %d: %v", size, err)
+		}
+	}
+	failed := fmt.Errorf("disk failed")
+	reader := io.MultiReader(bytes.NewReader(data[:len(data)/2]), failingReader{err: failed})
+	_, err := ReBuildTree(reader, unMarshal)
+	if streamErr, ok := err.(*StreamError); ok == false || streamErr.Err != failed {
+		t.Errorf("expect %v,got %v", failed, err)
+	}
+}
+
+func TestStreamHeader(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"abc", "abcdef", "xyz"} {
+		tree.ReplaceOrInsert([]byte(key), []byte(key))
+	}
+	unMarshal := func(data []byte) (interface{}, error) {
+		return string(data), nil
+	}
+	data := writeToBytes(t, tree)
+	rebuild, err := ReBuildTree(bytes.NewReader(data), unMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := treeKeys(rebuild); reflect.DeepEqual(keys, treeKeys(tree)) == false {
+		t.Errorf("no match \n%+v\n%+v\n", keys, treeKeys(tree))
+	}
+
+	header := streamHeader().Len()
+	rebuild, err = ReBuildTreeV1(bytes.NewReader(data[header:len(data)-5]), unMarshal)
+	if err != nil || rebuild.Len() != 3 {
+		t.Errorf("ReBuildTreeV1 %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		offset int
+		err    error
+	}{
+		{"magic", 0, ErrBadMagic},
+		{"version", header - 1, ErrBadVersion},
+	}
+	for _, Case := range cases {
+		corrupted := append([]byte{}, data...)
+		corrupted[Case.offset]++
+		if _, err := ReBuildTree(bytes.NewReader(corrupted), unMarshal); errors.Is(err, Case.err) == false {
+			t.Errorf("%s: expect %v,got %v", Case.name, Case.err, err)
+		}
+	}
+	if _, err := ReBuildTree(bytes.NewReader(data[header:]), unMarshal); errors.Is(err, ErrBadMagic) == false {
+		t.Errorf("v1 stream: expect %v,got %v", ErrBadMagic, err)
+	}
+}
+
+func TestStreamChecksum(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"abc", "abcdef", "xyz"} {
+		tree.ReplaceOrInsert([]byte(key), []byte(key))
+	}
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	data := writeToBytes(t, tree)
+	corrupted := append([]byte{}, data...)
+	// first byte of the first prefix
+	corrupted[streamHeader().Len()+2] ^= 0x20
+	if _, err := ReBuildTree(bytes.NewReader(corrupted), unMarshal); errors.Is(err, ErrChecksum) == false {
+		t.Errorf("expect %v,got %v", ErrChecksum, err)
+	}
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(corrupted)
+	gzipWriter.Close()
+	if _, err := ReBuildTreeWithGzip(&compressed, unMarshal); errors.Is(err, ErrChecksum) == false {
+		t.Errorf("gzip: expect %v,got %v", ErrChecksum, err)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestCompressed(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"abc", "abcdef", "abx", "xyz"} {
+		tree.ReplaceOrInsert([]byte(key), []byte(key))
+	}
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	marshaler := func(val interface{}) ([]byte, error) {
+		return val.([]byte), nil
+	}
+	cases := []struct {
+		name      string
+		newWriter func(io.Writer) (io.WriteCloser, error)
+		newReader func(io.Reader) (io.Reader, error)
+	}{
+		{
+			name: "identity",
+			newWriter: func(writer io.Writer) (io.WriteCloser, error) {
+				return nopWriteCloser{writer}, nil
+			},
+			newReader: func(reader io.Reader) (io.Reader, error) {
+				return reader, nil
+			},
+		},
+		{
+			name: "gzip",
+			newWriter: func(writer io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriter(writer), nil
+			},
+			newReader: func(reader io.Reader) (io.Reader, error) {
+				return gzip.NewReader(reader)
+			},
+		},
+	}
+	for _, Case := range cases {
+		var buffer bytes.Buffer
+		if _, err := tree.WriteToCompressed(&buffer, Case.newWriter, marshaler); err != nil {
+			t.Fatal(err)
+		}
+		rebuild, err := ReBuildTreeCompressed(&buffer, Case.newReader, unMarshal)
+		if err != nil {
+			t.Fatalf("%s: %v", Case.name, err)
+		}
+		if keys := treeKeys(rebuild); reflect.DeepEqual(keys, treeKeys(tree)) == false {
+			t.Errorf("%s: no match \n%+v\n%+v\n", Case.name, keys, treeKeys(tree))
+		}
+	}
+
+	// the compressor is closed when WriteTo fails,the marshal error wins
+	var closed bool
+	_, err := tree.WriteToCompressed(ioutil.Discard, func(writer io.Writer) (io.WriteCloser, error) {
+		return closeFunc{writer, func() error {
+			closed = true
+			return fmt.Errorf("close error")
+		}}, nil
+	}, func(interface{}) ([]byte, error) {
+		return nil, fmt.Errorf("marshal error")
+	})
+	if closed == false || err == nil || err.Error() != "marshal error" {
+		t.Errorf("closed %v err %v", closed, err)
+	}
+}
+
+type closeFunc struct {
+	io.Writer
+	close func() error
+}
+
+func (c closeFunc) Close() error {
+	return c.close()
+}
+
+func TestWriteToWithGzipLevel(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.ReplaceOrInsert([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprint(i)))
+	}
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	marshaler := func(val interface{}) ([]byte, error) {
+		return val.([]byte), nil
+	}
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		var buffer bytes.Buffer
+		if _, err := tree.WriteToWithGzipLevel(&buffer, level, marshaler); err != nil {
+			t.Fatal(err)
+		}
+		rebuild, err := ReBuildTreeWithGzip(&buffer, unMarshal)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if keys := treeKeys(rebuild); reflect.DeepEqual(keys, treeKeys(tree)) == false {
+			t.Errorf("level %d: no match \n%+v\n%+v\n", level, keys, treeKeys(tree))
+		}
+	}
+	if _, err := tree.WriteToWithGzipLevel(ioutil.Discard, 42, marshaler); err == nil {
+		t.Errorf("expect invalid level error")
+	}
+}
+
+type cancelReader struct {
+	reader io.Reader
+	after  int
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	if r.after--; r.after == 0 {
+		r.cancel()
+	}
+	return r.reader.Read(p)
+}
+
+func TestReBuildTreeContextCancel(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &cancelReader{
+		reader: io.MultiReader(streamHeader(), &endlessReader{}),
+		after:  64,
+		cancel: cancel,
+	}
+	_, err := ReBuildTreeContext(ctx, reader, func(data []byte) (interface{}, error) {
+		return data, nil
+	}, nil)
+	if err != context.Canceled {
+		t.Fatalf("expect context.Canceled,got %v", err)
+	}
+	waitGoroutines(t, goroutines)
+}
+
+func TestWalkContext(t *testing.T) {
+	tree := New()
+	for i := 0; i < 2000; i++ {
+		tree.ReplaceOrInsert([]byte(fmt.Sprintf("key-%04d", i)), i)
+	}
+	var count int
+	if err := tree.WalkContext(context.Background(), func(key []byte, value interface{}) error {
+		if string(key) != fmt.Sprintf("key-%04d", value) {
+			t.Errorf("no match %s %v", key, value)
+		}
+		count++
+		return nil
+	}); err != nil || count != 2000 {
+		t.Errorf("WalkContext %d %v", count, err)
+	}
+
+	failed := fmt.Errorf("sink failed")
+	count = 0
+	if err := tree.WalkContext(context.Background(), func(key []byte, value interface{}) error {
+		if count++; count == 10 {
+			return failed
+		}
+		return nil
+	}); err != failed || count != 10 {
+		t.Errorf("expect %v after 10 keys,got %v after %d", failed, err, count)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count = 0
+	if err := tree.WalkContext(ctx, func(key []byte, value interface{}) error {
+		if count++; count == 10 {
+			cancel()
+		}
+		return nil
+	}); err != context.Canceled || count >= 2000 {
+		t.Errorf("expect context.Canceled,got %v after %d", err, count)
+	}
+}
+
+func TestWalkKeys(t *testing.T) {
+	keys := []string{"", "a", "ab", "abc", "abd", "b", "bcd"}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	var result []string
+	tree.WalkKeys(func(key []byte, _ interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if reflect.DeepEqual(keys, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", keys, result)
+	}
+}
+
+/*
+BenchmarkWalk     	      15	  83404640 ns/op	53393096 B/op	  400000 allocs/op
+BenchmarkWalkKeys 	     158	   7237064 ns/op	  286784 B/op	    2241 allocs/op
+*/
+func BenchmarkWalk(b *testing.B) {
+	tree := loadFilesTree(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Walk(func(prefixes [][]byte, _ interface{}) bool {
+			_ = bytes.Join(prefixes, nil)
+			return true
+		})
+	}
+}
+
+func BenchmarkWalkKeys(b *testing.B) {
+	tree := loadFilesTree(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.WalkKeys(func(key []byte, _ interface{}) bool {
+			return true
+		})
+	}
+}
+
+func TestTypedTree(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	tree := NewTypedTree[user]()
+	users := []user{{"alice", 30}, {"bob", 25}, {"bobby", 8}}
+	for _, u := range users {
+		tree.Insert([]byte(u.Name), u)
+	}
+	if u, ok := tree.Get([]byte("bob")); ok == false || u.Age != 25 {
+		t.Errorf("Get %+v %v", u, ok)
+	}
+	if u, ok := tree.Get([]byte("bo")); ok || u != (user{}) {
+		t.Errorf("Get %+v %v", u, ok)
+	}
+	var result []user
+	tree.Walk(func(key []byte, u user) bool {
+		result = append(result, u)
+		return true
+	})
+	if reflect.DeepEqual(users, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", users, result)
+	}
+	tree.Delete([]byte("bob"))
+	if _, ok := tree.Get([]byte("bob")); ok || tree.Len() != 2 {
+		t.Errorf("Delete failed %d", tree.Len())
+	}
+}
+
+func TestStringKeys(t *testing.T) {
+	keys := []string{"", "a", "ab", "abc", "abd", "b", "bcd"}
+	tree, stringTree := New(), New()
+	for i, key := range keys {
+		tree.ReplaceOrInsert([]byte(key), i)
+		stringTree.InsertString(key, i)
+	}
+	tree.Delete([]byte("ab"))
+	stringTree.DeleteString("ab")
+	for _, key := range append(keys, "abcd", "x") {
+		if tree.Find([]byte(key)) != stringTree.FindString(key) {
+			t.Errorf("FindString %s no match", key)
+		}
+		value, ok := tree.Get([]byte(key))
+		stringValue, stringOk := stringTree.GetString(key)
+		if value != stringValue || ok != stringOk {
+			t.Errorf("GetString %s no match %v %v", key, value, stringValue)
+		}
+	}
+	if reflect.DeepEqual(treeKeys(tree), treeKeys(stringTree)) == false {
+		t.Errorf("no match \n%+v\n%+v\n", treeKeys(tree), treeKeys(stringTree))
+	}
+}
+
+func TestClear(t *testing.T) {
+	keys := []string{"", "aaa", "aaabbb", "aaaccc", "aaacccbbb", "b"}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	tree.Clear()
+	if tree.Len() != 0 || len(treeKeys(tree)) != 0 {
+		t.Errorf("tree not empty %+v", treeKeys(tree))
+	}
+	if size := len(tree.cow.freelist.nodes); size == 0 {
+		t.Error("cleared nodes not freed")
+	}
+
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	if reflect.DeepEqual(keys, treeKeys(tree)) == false {
+		t.Errorf("no match \n%+v\n%+v\n", keys, treeKeys(tree))
+	}
+	clone := tree.Clone()
+	tree.Insert([]byte("aaad"))
+	tree.Clear()
+	if reflect.DeepEqual(keys, treeKeys(clone)) == false {
+		t.Errorf("clone changed %+v", treeKeys(clone))
+	}
+	tree.Insert([]byte("x"))
+	if reflect.DeepEqual([]string{"x"}, treeKeys(tree)) == false || clone.Len() != len(keys) {
+		t.Errorf("no match %+v", treeKeys(tree))
+	}
+}
+
+func TestNewWithFreeList(t *testing.T) {
+	if _, err := NewWithFreeListSize(-1); err == nil {
+		t.Error("expect negative size error")
+	}
+	freelist := NewFreeList(1024)
+	tree1, tree2 := NewWithFreeList(freelist), NewWithFreeList(freelist)
+	for _, key := range []string{"a", "ab", "abc", "b"} {
+		tree1.Insert([]byte(key))
+	}
+	tree1.Clear()
+	if len(freelist.nodes) == 0 {
+		t.Fatal("cleared nodes not freed")
+	}
+	size := len(freelist.nodes)
+	tree2.Insert([]byte("x"))
+	if len(freelist.nodes) != size-1 {
+		t.Errorf("shared free list not used %d %d", size, len(freelist.nodes))
+	}
+
+	tree := NewWithFreeList(nil)
+	tree.Insert([]byte("a"))
+	if tree.cow.freelist == nil || tree.cow.freelist.size != DefaultFreeListSize || tree.Has([]byte("a")) == false {
+		t.Errorf("nil free list")
+	}
+}
+
+/*
+BenchmarkFreeListSmall 	     422	   3147993 ns/op	 1171446 B/op	   30936 allocs/op
+BenchmarkFreeListLarge 	     528	   2442855 ns/op	  251870 B/op	   20019 allocs/op
+*/
+func benchmarkFreeListSize(b *testing.B, size int) {
+	tree, err := NewWithFreeListSize(size)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Clear()
+		for _, key := range keys {
+			tree.Insert(key)
+		}
+	}
+}
+
+func BenchmarkFreeListSmall(b *testing.B) {
+	benchmarkFreeListSize(b, DefaultFreeListSize)
+}
+
+func BenchmarkFreeListLarge(b *testing.B) {
+	benchmarkFreeListSize(b, 1<<14)
+}
+
+func TestBulkInsertSorted(t *testing.T) {
+	var keys [][]byte
+	for _, key := range []string{"", "a", "ab", "abc", "abc", "abd", "abdx", "b", "ba", "bcd", "bce", "c"} {
+		keys = append(keys, []byte(key))
+	}
+	values := make([]interface{}, len(keys))
+	for i := range values {
+		values[i] = i
+	}
+	expect := New()
+	for i, key := range keys {
+		expect.ReplaceOrInsert(key, values[i])
+	}
+	tree := New()
+	tree.Insert([]byte("abcd"))
+	tree.Insert([]byte("bc"))
+	clone := tree.Clone()
+	expect.Insert([]byte("abcd"))
+	expect.Insert([]byte("bc"))
+	if err := tree.BulkInsertSorted(keys, values); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(writeToBytes(t, expect), writeToBytes(t, tree)) == false || expect.Len() != tree.Len() {
+		t.Errorf("no match \n%+v\n%+v\n", treeKeys(expect), treeKeys(tree))
+	}
+	if reflect.DeepEqual([]string{"abcd", "bc"}, treeKeys(clone)) == false {
+		t.Errorf("clone changed %+v", treeKeys(clone))
+	}
+
+	var random [][]byte
+	for i := 0; i < 5000; i++ {
+		random = append(random, []byte(fmt.Sprint(i*7919%10007)))
+	}
+	sort.Slice(random, func(i, j int) bool {
+		return bytes.Compare(random[i], random[j]) < 0
+	})
+	expect, tree = New(), New()
+	for _, key := range random {
+		expect.Insert(key)
+	}
+	if err := tree.BulkInsertSorted(random, nil); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(writeToBytes(t, expect), writeToBytes(t, tree)) == false || expect.Len() != tree.Len() {
+		t.Errorf("random keys no match %d %d", expect.Len(), tree.Len())
+	}
+
+	unsorted := New()
+	unsorted.Insert([]byte("x"))
+	if err := unsorted.BulkInsertSorted([][]byte{[]byte("a"), []byte("c"), []byte("b")}, nil); err == nil {
+		t.Error("expect unsorted error")
+	}
+	if unsorted.Len() != 1 || unsorted.Has([]byte("a")) {
+		t.Errorf("unsorted keys inserted %+v", treeKeys(unsorted))
+	}
+	if err := New().BulkInsertSorted(keys, values[1:]); err == nil {
+		t.Error("expect length error")
+	}
+}
+
+/*
+BenchmarkInsertSorted     	      10	 137962244 ns/op	37404211 B/op	  794908 allocs/op
+BenchmarkBulkInsertSorted 	      12	  98710919 ns/op	37404709 B/op	  794912 allocs/op
+*/
+func BenchmarkInsertSorted(b *testing.B) {
+	keys := sortedFileKeys(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := New()
+		for _, key := range keys {
+			tree.Insert(key)
+		}
+	}
+}
+
+func BenchmarkBulkInsertSorted(b *testing.B) {
+	keys := sortedFileKeys(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := New().BulkInsertSorted(keys, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func sortedFileKeys(b *testing.B) [][]byte {
+	var keys [][]byte
+	loadFilesTree(b).WalkKeys(func(key []byte, _ interface{}) bool {
+		keys = append(keys, bytesCopy(key))
+		return true
+	})
+	return keys
+}
+
+func TestKeysValues(t *testing.T) {
+	keys := []string{"bcd", "", "abd", "a", "abc", "b", "ab"}
+	tree := New()
+	for _, key := range keys {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	sort.Strings(keys)
+	var result []string
+	for _, key := range tree.Keys() {
+		result = append(result, string(key))
+	}
+	if reflect.DeepEqual(keys, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", keys, result)
+	}
+	values := tree.Values()
+	for i, key := range keys {
+		if values[i] != key {
+			t.Errorf("no match %s %v", key, values[i])
+		}
+	}
+
+	retained := tree.Keys()
+	retained[1][0] = 'x'
+	tree.Delete([]byte("abc"))
+	if tree.Find([]byte("a")) == false || string(retained[1]) != "x" || len(retained) != len(keys) {
+		t.Errorf("keys not independent %q", retained)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	tree := New()
+	tree.Insert([]byte("ab"))
+	tree.Insert([]byte("abc"))
+	tree.Insert([]byte("ad\"\x01"))
+	var buffer bytes.Buffer
+	if err := tree.WriteDOT(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	expect := `digraph rtree {
+	node [shape=box];
+	n0 [label=""];
+	n1 [label="a"];
+	n0 -> n1;
+	n2 [label="b" peripheries=2];
+	n1 -> n2;
+	n3 [label="c" peripheries=2];
+	n2 -> n3;
+	n4 [label="d\"\\x01" peripheries=2];
+	n1 -> n4;
+}
+`
+	if buffer.String() != expect {
+		t.Errorf("no match \n%s\n%s\n", expect, buffer.String())
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"b", "bb", "bbc", "bd", "c", "ca"} {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	cases := []struct {
+		key     string
+		floor   interface{}
+		ceiling interface{}
+	}{
+		{"a", nil, "b"},
+		{"b", "b", "b"},
+		{"ba", "b", "bb"},
+		{"bbb", "bb", "bbc"},
+		{"bbc", "bbc", "bbc"},
+		{"bbcz", "bbc", "bd"},
+		{"bc", "bbc", "bd"},
+		{"bz", "bd", "c"},
+		{"c", "c", "c"},
+		{"cb", "ca", nil},
+		{"d", "ca", nil},
+	}
+	for _, Case := range cases {
+		if key, value, ok := tree.Floor([]byte(Case.key)); value != Case.floor || ok != (Case.floor != nil) ||
+			(ok && string(key) != Case.floor) {
+			t.Errorf("Floor %s: %s %v %v", Case.key, key, value, ok)
+		}
+		if key, value, ok := tree.Ceiling([]byte(Case.key)); value != Case.ceiling || ok != (Case.ceiling != nil) ||
+			(ok && string(key) != Case.ceiling) {
+			t.Errorf("Ceiling %s: %s %v %v", Case.key, key, value, ok)
+		}
+	}
+
+	if _, _, ok := tree.Floor(nil); ok {
+		t.Errorf("Floor of empty key without empty key")
+	}
+	tree.ReplaceOrInsert([]byte{}, "")
+	if key, value, ok := tree.Floor([]byte("a")); ok == false || len(key) != 0 || value != "" {
+		t.Errorf("Floor empty key %q %v %v", key, value, ok)
+	}
+	if key, value, ok := tree.Ceiling(nil); ok == false || len(key) != 0 || value != "" {
+		t.Errorf("Ceiling empty key %q %v %v", key, value, ok)
+	}
+}
+
+type binaryValue struct {
+	Name  string
+	Count int
+}
+
+func TestMarshalBinary(t *testing.T) {
+	gob.Register(binaryValue{})
+	tree := New()
+	tree.ReplaceOrInsert([]byte("a"), binaryValue{"a", 1})
+	tree.ReplaceOrInsert([]byte("ab"), binaryValue{"ab", 2})
+	tree.ReplaceOrInsert([]byte("b"), "b")
+	tree.Insert([]byte("c"))
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reload Tree
+	if err := reload.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(tree.Keys(), reload.Keys()) == false ||
+		reflect.DeepEqual(tree.Values(), reload.Values()) == false {
+		t.Errorf("no match \n%+v\n%+v\n", tree.Values(), reload.Values())
+	}
+	reload.Insert([]byte("d"))
+	if reload.Len() != 5 {
+		t.Errorf("Len %d", reload.Len())
+	}
+
+	tree.ReplaceOrInsert([]byte("x"), struct{ X int }{1})
+	if _, err := tree.MarshalBinary(); err == nil {
+		t.Error("expect unregistered type error")
+	}
+}
+
+func TestMarshalTo(t *testing.T) {
+	tree := New()
+	for i, key := range []string{"", "a", "ab", "abc", "b"} {
+		tree.ReplaceOrInsert([]byte(key), i)
+	}
+	var buffer bytes.Buffer
+	n, err := tree.MarshalTo(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buffer.Len()) {
+		t.Errorf("MarshalTo returned %d,wrote %d", n, buffer.Len())
+	}
+	size := buffer.Len()
+	var reload io.ReaderFrom = New()
+	if n, err = reload.ReadFrom(&buffer); err != nil || n != int64(size) {
+		t.Errorf("ReadFrom %d %v", n, err)
+	}
+	if reflect.DeepEqual(tree.Values(), reload.(*Tree).Values()) == false {
+		t.Errorf("no match \n%+v\n%+v\n", tree.Values(), reload.(*Tree).Values())
+	}
+}
+
+func TestHas(t *testing.T) {
+	tree := New()
+	tree.Insert([]byte("abc"))
+	tree.Insert([]byte("abcdef"))
+	tree.Insert([]byte("abx"))
+	cases := []struct {
+		key    string
+		has    bool
+		prefix bool
+	}{
+		{"", false, true},
+		{"a", false, true},
+		{"ab", false, true},
+		{"abc", true, true},
+		{"abcd", false, true},
+		{"abcdef", true, true},
+		{"abcdefg", false, false},
+		{"abx", true, true},
+		{"aby", false, false},
+		{"b", false, false},
+	}
+	for _, Case := range cases {
+		if has := tree.Has([]byte(Case.key)); has != Case.has || tree.Find([]byte(Case.key)) != has {
+			t.Errorf("Has %s: expect %v", Case.key, Case.has)
+		}
+		if prefix := tree.AnyPrefix([]byte(Case.key), func(interface{}) bool { return true }); prefix != Case.prefix {
+			t.Errorf("AnyPrefix %s: expect %v", Case.key, Case.prefix)
+		}
+	}
+}
+
+func TestToMapFromMap(t *testing.T) {
+	tree := New()
+	for i, key := range []string{"", "a", "ab", "abc", "abd", "b", "bcd"} {
+		tree.ReplaceOrInsert([]byte(key), i)
+	}
+	m := tree.ToMap()
+	if len(m) != tree.Len() || m["abc"] != 3 || m[""] != 0 {
+		t.Errorf("ToMap %+v", m)
+	}
+	reload := FromMap(m)
+	if reflect.DeepEqual(tree.Keys(), reload.Keys()) == false ||
+		reflect.DeepEqual(tree.Values(), reload.Values()) == false {
+		t.Errorf("no match \n%+v\n%+v\n", treeKeys(tree), treeKeys(reload))
+	}
+	if bytes.Equal(writeToBytes(t, FromMap(m)), writeToBytes(t, reload)) == false {
+		t.Error("FromMap not deterministic")
+	}
+
+	tree.Set([]byte("nil"), nil)
+	if reload := FromMap(tree.ToMap()); reflect.DeepEqual(tree.ToMap(), reload.ToMap()) == false || reload.Len() != tree.Len() {
+		t.Errorf("nil value lost \n%+v\n%+v\n", tree.ToMap(), reload.ToMap())
+	}
+}
+
+func TestWalkBFS(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"usr/bin", "usr/lib", "usr/lib/go", "var", "var/log"} {
+		tree.Insert([]byte(key))
+	}
+	type visit struct {
+		key   string
+		value bool
+		depth int
+	}
+	cases := []struct {
+		maxDepth int
+		expect   []visit
+	}{
+		{1, []visit{{"usr/", false, 1}, {"var", true, 1}}},
+		{-1, []visit{
+			{"usr/", false, 1}, {"var", true, 1},
+			{"usr/bin", true, 2}, {"usr/lib", true, 2}, {"var/log", true, 2},
+			{"usr/lib/go", true, 3},
+		}},
+	}
+	for _, Case := range cases {
+		var result []visit
+		tree.WalkBFS(Case.maxDepth, func(key []byte, value interface{}, depth int) bool {
+			result = append(result, visit{string(key), value != nil, depth})
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("no match \n%+v\n%+v\n", Case.expect, result)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	newTree := func(keys ...string) *Tree {
+		tree := New()
+		for _, key := range keys {
+			tree.ReplaceOrInsert([]byte(key), key+"@"+fmt.Sprint(len(keys)))
+		}
+		return tree
+	}
+	sum := func(key []byte, a, b interface{}) interface{} {
+		return a.(string) + "+" + b.(string)
+	}
+	cases := []struct {
+		a, b   []string
+		expect map[string]interface{}
+	}{
+		{
+			a: []string{"a", "ab"},
+			b: []string{"b", "bc", "c"},
+			expect: map[string]interface{}{
+				"a": "a@2", "ab": "ab@2", "b": "b@3", "bc": "bc@3", "c": "c@3",
+			},
+		},
+		{
+			a: []string{"", "a", "abc", "b"},
+			b: []string{"", "ab", "abc"},
+			expect: map[string]interface{}{
+				"": "@4+@3", "a": "a@4", "ab": "ab@3", "abc": "abc@4+abc@3", "b": "b@4",
+			},
+		},
+	}
+	for _, Case := range cases {
+		tree, other := newTree(Case.a...), newTree(Case.b...)
+		clone := tree.Clone()
+		otherKeys := treeKeys(other)
+		tree.Merge(other, sum)
+		if reflect.DeepEqual(Case.expect, tree.ToMap()) == false {
+			t.Errorf("no match \n%+v\n%+v\n", Case.expect, tree.ToMap())
+		}
+		if reflect.DeepEqual(Case.a, treeKeys(clone)) == false {
+			t.Errorf("clone changed %+v", treeKeys(clone))
+		}
+		if reflect.DeepEqual(otherKeys, treeKeys(other)) == false {
+			t.Errorf("other changed %+v", treeKeys(other))
+		}
+		if tree.Len() != len(Case.expect) {
+			t.Errorf("Len %d", tree.Len())
+		}
+	}
+}
+
+func TestIntersectDifference(t *testing.T) {
+	newTree := func(keys ...string) *Tree {
+		tree := New()
+		for _, key := range keys {
+			tree.ReplaceOrInsert([]byte(key), key)
+		}
+		return tree
+	}
+	cases := []struct {
+		name       string
+		a, b       []string
+		intersect  []string
+		difference []string
+	}{
+		{"overlapping", []string{"a", "ab", "abc", "b"}, []string{"ab", "b", "bc"}, []string{"ab", "b"}, []string{"a", "abc"}},
+		{"disjoint", []string{"a", "ab"}, []string{"b", "abc"}, nil, []string{"a", "ab"}},
+		{"subset", []string{"ab"}, []string{"", "a", "ab", "abc"}, []string{"ab"}, nil},
+		{"superset", []string{"", "a", "ab", "abc"}, []string{"a"}, []string{"a"}, []string{"", "ab", "abc"}},
+	}
+	for _, Case := range cases {
+		tree, other := newTree(Case.a...), newTree(Case.b...)
+		intersect, difference := tree.Intersect(other), tree.Difference(other)
+		if reflect.DeepEqual(Case.intersect, treeKeys(intersect)) == false {
+			t.Errorf("%s: Intersect no match \n%+v\n%+v\n", Case.name, Case.intersect, treeKeys(intersect))
+		}
+		if reflect.DeepEqual(Case.difference, treeKeys(difference)) == false {
+			t.Errorf("%s: Difference no match \n%+v\n%+v\n", Case.name, Case.difference, treeKeys(difference))
+		}
+		intersect.Insert([]byte("zz"))
+		difference.Insert([]byte("zz"))
+		if tree.Has([]byte("zz")) || other.Has([]byte("zz")) {
+			t.Errorf("%s: result shares nodes with inputs", Case.name)
+		}
+	}
+
+	// keys Set to nil keep their nil value
+	tree, other := newTree("b"), newTree("ab", "b")
+	tree.Set([]byte("ab"), nil)
+	for _, result := range []*Tree{tree.Intersect(other), other.Intersect(tree)} {
+		if reflect.DeepEqual([]string{"ab", "b"}, treeKeys(result)) == false {
+			t.Errorf("nil value: Intersect no match \n%+v\n", treeKeys(result))
+		}
+	}
+	if value, ok := tree.Intersect(other).Get([]byte("ab")); ok == false || value != nil {
+		t.Errorf("nil value: Intersect Get %v %v", value, ok)
+	}
+	if value, ok := tree.Difference(newTree("b")).Get([]byte("ab")); ok == false || value != nil {
+		t.Errorf("nil value: Difference Get %v %v", value, ok)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := New()
+	for _, key := range []string{"", "a", "ab", "abc", "b", "bcd"} {
+		old.ReplaceOrInsert([]byte(key), key)
+	}
+	updated := old.Clone()
+	updated.Delete([]byte(""))
+	updated.Delete([]byte("abc"))
+	updated.ReplaceOrInsert([]byte("ab"), "AB")
+	updated.ReplaceOrInsert([]byte("abd"), "abd")
+	updated.ReplaceOrInsert([]byte("bcd"), "BCD")
+	updated.ReplaceOrInsert([]byte("c"), "c")
+
+	var result []string
+	record := func(op string) func(key []byte, oldVal, newVal interface{}) {
+		return func(key []byte, oldVal, newVal interface{}) {
+			result = append(result, fmt.Sprintf("%s %s %v %v", op, key, oldVal, newVal))
+		}
+	}
+	Diff(old, updated, record("add"), record("del"), record("change"))
+	expect := []string{
+		"del   <nil>",
+		"change ab ab AB",
+		"del abc abc <nil>",
+		"add abd <nil> abd",
+		"change bcd bcd BCD",
+		"add c <nil> c",
+	}
+	if reflect.DeepEqual(expect, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, result)
+	}
+}
+
+func denseKeys() [][]byte {
+	return fanOutKeys(1)
+}
+
+// fanOutKeys uses every step-th byte at the first two levels
+func fanOutKeys(step int) [][]byte {
+	var keys [][]byte
+	for i := 0; i < 256; i += step {
+		for j := 0; j < 256; j += step {
+			keys = append(keys, []byte{byte(i), byte(j), 'x'})
+		}
+	}
+	return keys
+}
+
+/*
+binary search
+BenchmarkDenseGet    	10692781	       112.7 ns/op	       0 B/op	       0 allocs/op
+BenchmarkDenseInsert 	      81	  14384277 ns/op	 7564270 B/op	  196897 allocs/op
+direct index for contiguous children
+BenchmarkDenseGet    	54060684	        18.88 ns/op	       0 B/op	       0 allocs/op
+BenchmarkDenseInsert 	      96	  11806913 ns/op	 7564270 B/op	  196897 allocs/op
+*/
+func BenchmarkDenseGet(b *testing.B) {
+	keys := denseKeys()
+	tree := New()
+	for _, key := range keys {
+		tree.Insert(key)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Get(keys[i&0xffff])
+	}
+}
+
+/*
+every other byte at the first two levels,the children are not one contiguous
+run and take the binary search. same run,1 CPU
+BenchmarkDenseGet  	66307717	        15.91 ns/op	       0 B/op	       0 allocs/op
+BenchmarkGappedGet 	16908756	        76.97 ns/op	       0 B/op	       0 allocs/op
+*/
+func BenchmarkGappedGet(b *testing.B) {
+	keys := fanOutKeys(2)
+	tree := New()
+	for _, key := range keys {
+		tree.Insert(key)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Get(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkDenseInsert(b *testing.B) {
+	keys := denseKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := New()
+		for _, key := range keys {
+			tree.Insert(key)
+		}
+	}
+}
+
+func TestFindNodeDense(t *testing.T) {
+	run := func(low, high int, skip int) children {
+		var c children
+		for b := low; b <= high; b++ {
+			if b != skip {
+				c = append(c, &node{prefix: []byte{byte(b)}})
+			}
+		}
+		return c
+	}
+	cases := []children{
+		run(0, 255, -1),
+		run('a', 'z', -1),
+		run('a', 'z', 'k'),
+		run(200, 255, -1),
+		run(0, 40, -1),
+	}
+	for _, Case := range cases {
+		for b := 0; b < 256; b++ {
+			expect := sort.Search(len(Case), func(i int) bool {
+				return byte(b) <= Case[i].prefix[0]
+			})
+			var expectNode *node
+			if expect < len(Case) && Case[expect].prefix[0] == byte(b) {
+				expectNode = Case[expect]
+			}
+			if index, child := Case.findNode(byte(b)); index != expect || child != expectNode {
+				t.Errorf("findNode %d in [%d,%d]: %d %v", b, Case[0].prefix[0], Case[len(Case)-1].prefix[0], index, child)
+			}
+		}
+	}
+}
+
+func TestArena(t *testing.T) {
+	tree, expect := NewWithArena(), New()
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprint(i * 7919 % 10007))
+		tree.Insert(key)
+		expect.Insert(key)
+	}
+	clone := tree.Clone()
+	for i := 0; i < 5000; i += 3 {
+		key := []byte(fmt.Sprint(i * 7919 % 10007))
+		tree.Delete(key)
+		expect.Delete(key)
+	}
+	if bytes.Equal(writeToBytes(t, expect), writeToBytes(t, tree)) == false {
+		t.Errorf("arena tree no match %d %d", expect.Len(), tree.Len())
+	}
+	if clone.Len() != 5000 {
+		t.Errorf("clone changed %d", clone.Len())
+	}
+}
+
+/*
+BenchmarkInsertFiles      	      12	  92737401 ns/op	37404284 B/op	  794909 allocs/op
+BenchmarkInsertFilesArena 	      14	  80088719 ns/op	36513160 B/op	  594989 allocs/op
+*/
+func BenchmarkInsertFiles(b *testing.B) {
+	benchmarkInsertFiles(b, New)
+}
+
+func BenchmarkInsertFilesArena(b *testing.B) {
+	benchmarkInsertFiles(b, NewWithArena)
+}
+
+func benchmarkInsertFiles(b *testing.B, newTree func() *Tree) {
+	keys := sortedFileKeys(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := newTree()
+		for _, key := range keys {
+			tree.Insert(key)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	keys := []string{"a", "ab", "abc", "b", "bcd"}
+	tree := New()
+	for _, key := range keys {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	snapshot := tree.Snapshot()
+	tree.Delete([]byte("ab"))
+	tree.ReplaceOrInsert([]byte("abc"), "changed")
+	tree.Insert([]byte("abd"))
+	tree.Insert([]byte("c"))
+
+	if snapshot.Len() != len(keys) || snapshot.Has([]byte("ab")) == false || snapshot.Has([]byte("c")) {
+		t.Errorf("snapshot changed %d", snapshot.Len())
+	}
+	if value, ok := snapshot.Get([]byte("abc")); ok == false || value != "abc" {
+		t.Errorf("Get %v %v", value, ok)
+	}
+	var result []string
+	snapshot.WalkKeys(func(key []byte, _ interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if reflect.DeepEqual(keys, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", keys, result)
+	}
+	result = nil
+	snapshot.AscendRange([]byte("ab"), []byte("b"), func(key []byte, _ interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if reflect.DeepEqual([]string{"ab", "abc"}, result) == false {
+		t.Errorf("AscendRange no match %+v", result)
+	}
+}
+
+func TestCloneLocked(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.ReplaceOrInsert([]byte(fmt.Sprint(i)), i)
+	}
+	var mutex sync.Mutex
+	var readers, writers sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				tree.Get([]byte("500"))
+				tree.Has([]byte("999"))
+			}
+		}()
+	}
+	var clones [8]*Tree
+	for c := range clones {
+		writers.Add(1)
+		go func(c int) {
+			defer writers.Done()
+			clones[c] = tree.CloneLocked(&mutex)
+			clones[c].ReplaceOrInsert([]byte(fmt.Sprint(c)), "clone")
+		}(c)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	for c, clone := range clones {
+		if value, _ := clone.Get([]byte(fmt.Sprint(c))); value != "clone" || clone.Len() != 1000 {
+			t.Errorf("clone %d no match %v", c, value)
+		}
+	}
+	if value, _ := tree.Get([]byte("0")); value != 0 {
+		t.Errorf("tree changed %v", value)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	frequency := map[string]int{"go": 50, "gopher": 30, "golang": 90, "good": 30, "gold": 10, "java": 99}
+	tree := New()
+	for key, count := range frequency {
+		tree.ReplaceOrInsert([]byte(key), count)
+	}
+	score := func(key []byte, value interface{}) int {
+		return value.(int)
+	}
+	cases := []struct {
+		prefix string
+		n      int
+		expect []string
+	}{
+		{"go", 3, []string{"golang", "go", "good"}},
+		{"go", 0, []string{"golang", "go", "good", "gopher", "gold"}},
+		{"gol", 5, []string{"golang", "gold"}},
+		{"", 2, []string{"java", "golang"}},
+		{"x", 2, []string{}},
+	}
+	for _, Case := range cases {
+		result := []string{}
+		for _, key := range tree.Suggest([]byte(Case.prefix), Case.n, score) {
+			result = append(result, string(key))
+		}
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("%s %d: no match \n%+v\n%+v\n", Case.prefix, Case.n, Case.expect, result)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	keys := []string{
+		"", "logs", "logs/app/error", "logs/app/error.1", "logs/app/info",
+		"logs/db/error", "logs/db/x/error", "logs/web/errors", "tmp/a", "tmp/ab",
+	}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	cases := []struct {
+		pattern string
+		expect  []string
+	}{
+		{"logs/*/error", []string{"logs/app/error", "logs/db/error"}},
+		{"logs/*/error*", []string{"logs/app/error", "logs/app/error.1", "logs/db/error", "logs/web/errors"}},
+		{"logs/*/*", []string{"logs/app/error", "logs/app/error.1", "logs/app/info", "logs/db/error", "logs/web/errors"}},
+		{"*/a?", []string{"tmp/ab"}},
+		{"tmp/?", []string{"tmp/a"}},
+		{"*", []string{"", "logs"}},
+		{"lo*", []string{"logs"}},
+		{"logs", []string{"logs"}},
+		{"log", nil},
+		{"x*", nil},
+	}
+	for _, Case := range cases {
+		var result []string
+		tree.MatchGlob([]byte(Case.pattern), func(key []byte, _ interface{}) bool {
+			result = append(result, string(key))
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("%s: no match \n%+v\n%+v\n", Case.pattern, Case.expect, result)
+		}
+	}
+}
+
+func levenshtein(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := prev + cost
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if row[j-1]+1 < next {
+				next = row[j-1] + 1
+			}
+			prev, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	keys := []string{"", "a", "ab", "cat", "cart", "cast", "cats", "act", "at", "bat", "dog", "cattle", "scat"}
+	tree := New()
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	for _, query := range []string{"cat", "", "ca", "dgo", "battle", "xyz"} {
+		for maxDist := 0; maxDist <= 2; maxDist++ {
+			var expect, result []string
+			for _, key := range keys {
+				if dist := levenshtein(query, key); dist <= maxDist {
+					expect = append(expect, fmt.Sprintf("%s:%d", key, dist))
+				}
+			}
+			sort.Strings(expect)
+			tree.FuzzyMatch([]byte(query), maxDist, func(key []byte, _ interface{}, dist int) bool {
+				result = append(result, fmt.Sprintf("%s:%d", key, dist))
+				return true
+			})
+			sort.Strings(result)
+			if reflect.DeepEqual(expect, result) == false {
+				t.Errorf("%s %d: no match \n%+v\n%+v\n", query, maxDist, expect, result)
+			}
+		}
+	}
+}
+
+func TestSubTree(t *testing.T) {
+	keys := []string{"a", "users/", "users/alice", "users/alice/home", "users/bob", "usersx"}
+	tree := New()
+	for _, key := range keys {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	cases := []struct {
+		prefix string
+		expect []string
+		ok     bool
+	}{
+		{"users/", []string{"", "alice", "alice/home", "bob"}, true},
+		{"users/al", []string{"ice", "ice/home"}, true},
+		{"users/alice/", []string{"home"}, true},
+		{"users/c", nil, false},
+		{"b", nil, false},
+		{"", keys, true},
+	}
+	for _, Case := range cases {
+		sub, ok := tree.SubTree([]byte(Case.prefix))
+		if ok != Case.ok {
+			t.Errorf("%s: expect %v", Case.prefix, Case.ok)
+			continue
+		}
+		if ok == false {
+			continue
+		}
+		if reflect.DeepEqual(Case.expect, treeKeys(sub)) == false || sub.Len() != len(Case.expect) {
+			t.Errorf("%s: no match \n%+v\n%+v\n", Case.prefix, Case.expect, treeKeys(sub))
+		}
+		if value, _ := sub.Get([]byte(Case.expect[len(Case.expect)-1])); value != Case.prefix+Case.expect[len(Case.expect)-1] {
+			t.Errorf("%s: value no match %v", Case.prefix, value)
+		}
+	}
+
+	sub, _ := tree.SubTree([]byte("users/a"))
+	sub.Insert([]byte("nna"))
+	sub.Delete([]byte("lice/home"))
+	tree.Delete([]byte("users/alice"))
+	tree.Insert([]byte("users/alicia"))
+	if reflect.DeepEqual([]string{"lice", "nna"}, treeKeys(sub)) == false {
+		t.Errorf("subtree no match %+v", treeKeys(sub))
+	}
+	expect := []string{"a", "users/", "users/alice/home", "users/alicia", "users/bob", "usersx"}
+	if reflect.DeepEqual(expect, treeKeys(tree)) == false {
+		t.Errorf("tree no match %+v", treeKeys(tree))
+	}
+}
+
+func TestNextPrev(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"b", "bb", "bbc", "bd", "c", "ca"} {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	cases := []struct {
+		key  string
+		prev interface{}
+		next interface{}
+	}{
+		{"", nil, "b"},
+		{"a", nil, "b"},
+		{"b", nil, "bb"},
+		{"ba", "b", "bb"},
+		{"bb", "b", "bbc"},
+		{"bbb", "bb", "bbc"},
+		{"bbc", "bb", "bd"},
+		{"bc", "bbc", "bd"},
+		{"c", "bd", "ca"},
+		{"ca", "c", nil},
+		{"d", "ca", nil},
+	}
+	for _, Case := range cases {
+		if key, value, ok := tree.Prev([]byte(Case.key)); value != Case.prev || ok != (Case.prev != nil) ||
+			(ok && string(key) != Case.prev) {
+			t.Errorf("Prev %s: %s %v %v", Case.key, key, value, ok)
+		}
+		if key, value, ok := tree.Next([]byte(Case.key)); value != Case.next || ok != (Case.next != nil) ||
+			(ok && string(key) != Case.next) {
+			t.Errorf("Next %s: %s %v %v", Case.key, key, value, ok)
+		}
+	}
+	tree.ReplaceOrInsert([]byte{}, "")
+	if key, value, ok := tree.Prev([]byte("b")); ok == false || len(key) != 0 || value != "" {
+		t.Errorf("Prev empty key %q %v %v", key, value, ok)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	hashValue := func(value interface{}) []byte {
+		return []byte(fmt.Sprint(value))
+	}
+	tree := New()
+	for i, key := range []string{"a", "ab", "abc", "abd", "bcd"} {
+		tree.ReplaceOrInsert([]byte(key), i)
+	}
+	fingerprint := tree.Fingerprint(hashValue)
+	clone := tree.Clone()
+	if clone.Fingerprint(hashValue) != fingerprint {
+		t.Error("clone fingerprint changed")
+	}
+
+	// same contents built with a ghost node from a crafted stream
+	var buffer bytes.Buffer
+	writeStreamHeader(&buffer)
+	writeStreamNode(&buffer, "a", []byte("0"))
+	writeStreamNode(&buffer, "b", []byte("1"))
+	writeStreamNode(&buffer, "c", []byte("2"))
+	buffer.WriteByte(Pop)
+	writeStreamNode(&buffer, "d", []byte("3"))
+	buffer.WriteByte(Pop)
+	buffer.WriteByte(Pop)
+	buffer.WriteByte(Pop)
+	writeStreamNode(&buffer, "b", nil)
+	writeStreamNode(&buffer, "cd", []byte("4"))
+	buffer.WriteByte(Pop)
+	buffer.WriteByte(Pop)
+	sealStream(&buffer)
+	ghost, err := ReBuildTree(&buffer, func(data []byte) (interface{}, error) {
+		return strconv.Atoi(string(data))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ghost.Fingerprint(hashValue) != fingerprint {
+		t.Errorf("different structure changed fingerprint %+v", treeKeys(ghost))
+	}
+
+	clone.Insert([]byte("c"))
+	if clone.Fingerprint(hashValue) == fingerprint {
+		t.Error("insert kept fingerprint")
+	}
+	clone = tree.Clone()
+	clone.Delete([]byte("ab"))
+	if clone.Fingerprint(hashValue) == fingerprint {
+		t.Error("delete kept fingerprint")
+	}
+	clone = tree.Clone()
+	clone.ReplaceOrInsert([]byte("ab"), 42)
+	if clone.Fingerprint(hashValue) == fingerprint {
+		t.Error("value change kept fingerprint")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := New()
+	tree.ReplaceOrInsert([]byte("a"), 1)
+	tree.ReplaceOrInsert([]byte("ab"), 2)
+	clone := tree.Clone()
+	equal := func(a, b interface{}) bool {
+		return a == b
+	}
+	cases := []struct {
+		key      string
+		old, new interface{}
+		swapped  bool
+		expect   interface{}
+	}{
+		{"ab", 2, 3, true, 3},
+		{"ab", 2, 4, false, 3},
+		{"a", 0, 5, false, 1},
+		{"abc", nil, 6, false, nil},
+		{"", nil, 7, false, nil},
+		{"a", 1, nil, true, nil},
+		{"a", nil, 8, true, 8},
+	}
+	for _, Case := range cases {
+		if swapped := tree.CompareAndSwap([]byte(Case.key), Case.old, Case.new, equal); swapped != Case.swapped {
+			t.Errorf("CompareAndSwap %s %v->%v: expect %v", Case.key, Case.old, Case.new, Case.swapped)
+		}
+		if value, _ := tree.Get([]byte(Case.key)); value != Case.expect {
+			t.Errorf("%s: expect %v,got %v", Case.key, Case.expect, value)
+		}
+		if Case.swapped && tree.Has([]byte(Case.key)) == false {
+			t.Errorf("%s: swapped key missing", Case.key)
+		}
+	}
+	if tree.Len() != 2 {
+		t.Errorf("Len %d", tree.Len())
+	}
+	if value, _ := clone.Get([]byte("ab")); value != 2 {
+		t.Errorf("clone changed %v", value)
+	}
+}
+
+func TestStreamKeys(t *testing.T) {
+	tree := New()
+	for i := 0; i < 2000; i++ {
+		tree.ReplaceOrInsert([]byte(fmt.Sprint(i*7919%10007)), []byte(fmt.Sprint(i)))
+	}
+	tree.ReplaceOrInsert([]byte{}, []byte("empty"))
+	data := writeToBytes(t, tree)
+	unMarshal := func(data []byte) (interface{}, error) {
+		return string(data), nil
+	}
+	rebuild, err := ReBuildTree(bytes.NewReader(data), unMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expect, result []string
+	rebuild.WalkKeys(func(key []byte, value interface{}) bool {
+		expect = append(expect, string(key)+"="+value.(string))
+		return true
+	})
+	if err := StreamKeys(bytes.NewReader(data), unMarshal, func(key []byte, value interface{}) bool {
+		result = append(result, string(key)+"="+value.(string))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(expect, result) == false {
+		t.Errorf("no match %d %d", len(expect), len(result))
+	}
+
+	var count int
+	if err := StreamKeys(bytes.NewReader(data), unMarshal, func(key []byte, value interface{}) bool {
+		count++
+		return count < 10
+	}); err != nil || count != 10 {
+		t.Errorf("early stop %d %v", count, err)
+	}
+	if err := StreamKeys(bytes.NewReader(data[:len(data)/2]), unMarshal, func([]byte, interface{}) bool {
+		return true
+	}); err == nil {
+		t.Error("expect truncated stream error")
+	}
+}
+
+func TestWalkReverse(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"", "a", "ab", "abc", "abd", "b", "bcd", "bce"} {
+		tree.Insert([]byte(key))
+	}
+	forward := treeKeys(tree)
+	var result []string
+	tree.WalkReverse(func(key []byte, _ interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if len(forward) != len(result) {
+		t.Fatalf("no match \n%+v\n%+v\n", forward, result)
+	}
+	for i := range forward {
+		if forward[i] != result[len(result)-1-i] {
+			t.Fatalf("no match \n%+v\n%+v\n", forward, result)
+		}
+	}
+	result = nil
+	tree.WalkReverse(func(key []byte, _ interface{}) bool {
+		result = append(result, string(key))
+		return len(result) < 3
+	})
+	if reflect.DeepEqual([]string{"bce", "bcd", "b"}, result) == false {
+		t.Errorf("early stop no match %+v", result)
+	}
+}
+
+func TestString(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"ab", "abc", "abd\x00", "b"} {
+		tree.Insert([]byte(key))
+	}
+	expect := `.
+  ab *
+    c *
+    d\x00 *
+  b *
+`
+	if tree.String() != expect {
+		t.Errorf("no match \n%s\n%s\n", expect, tree.String())
+	}
+	expect = `.
+  ab *
+    ...
+  b *
+`
+	if dump := tree.StringDepth(1); dump != expect {
+		t.Errorf("no match \n%s\n%s\n", expect, dump)
+	}
+}
+
+func TestFreeListStats(t *testing.T) {
+	freelist := NewFreeList(1024)
+	tree := NewWithFreeList(freelist)
+	keys := []string{"a", "ab", "abc", "b", "bcd", "bce"}
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	hits, misses, returns := freelist.Stats()
+	if hits != 0 || misses == 0 || returns != 0 {
+		t.Errorf("after insert hits %d misses %d returns %d", hits, misses, returns)
+	}
+	for _, key := range keys {
+		tree.Delete([]byte(key))
+	}
+	_, _, returns = freelist.Stats()
+	if returns == 0 {
+		t.Errorf("no nodes returned after delete")
+	}
+	for _, key := range keys {
+		tree.Insert([]byte(key))
+	}
+	hits, misses2, _ := freelist.Stats()
+	if hits == 0 || misses2 != misses {
+		t.Errorf("after reinsert hits %d misses %d/%d", hits, misses, misses2)
+	}
+}
+
+func TestReBuildTreeEmptyPrefix(t *testing.T) {
+	for _, value := range [][]byte{nil, Empty} {
+		buffer := streamHeader()
+		writeStreamNode(buffer, "a", Empty)
+		offset := int64(buffer.Len())
+		writeStreamNode(buffer, "", value)
+		writeStreamNode(buffer, "b", Empty)
+		buffer.WriteByte(Pop)
+		buffer.WriteByte(Pop)
+		buffer.WriteByte(Pop)
+		sealStream(buffer)
+
+		_, err := ReBuildTree(buffer, func(data []byte) (interface{}, error) {
+			return data, nil
+		})
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) == false || errors.Is(err, ErrEmptyPrefix) == false {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if streamErr.Offset != offset {
+			t.Errorf("offset %d expect %d", streamErr.Offset, offset)
+		}
+	}
+
+	var nodes children
+	nodes = append(nodes, &node{})
+	for c := 'a'; c <= 'z'; c++ {
+		nodes = append(nodes, &node{prefix: []byte{byte(c)}})
+	}
+	for _, size := range []int{3, len(nodes)} {
+		if _, child := nodes[:size].findNode('b'); child == nil || child.prefix[0] != 'b' {
+			t.Errorf("findNode with empty prefix child failed")
+		}
+	}
+}
+
+func TestEmptyKeyStream(t *testing.T) {
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	noValue := streamHeader()
+	offset := int64(noValue.Len())
+	writeStreamNode(noValue, "", nil)
+	noValue.WriteByte(Pop)
+	writeStreamNode(noValue, "a", Empty)
+	noValue.WriteByte(Pop)
+	sealStream(noValue)
+
+	withChild := streamHeader()
+	writeStreamNode(withChild, "", Empty)
+	childOffset := int64(withChild.Len())
+	writeStreamNode(withChild, "b", Empty)
+	withChild.WriteByte(Pop)
+	withChild.WriteByte(Pop)
+	sealStream(withChild)
+
+	valid := streamHeader()
+	writeStreamNode(valid, "", Empty)
+	valid.WriteByte(Pop)
+	writeStreamNode(valid, "b", Empty)
+	valid.WriteByte(Pop)
+	sealStream(valid)
+
+	for _, Case := range []struct {
+		data   []byte
+		offset int64
+		count  int
+	}{
+		{data: noValue.Bytes(), offset: offset},
+		{data: withChild.Bytes(), offset: childOffset},
+		{data: valid.Bytes(), offset: -1, count: 2},
+	} {
+		results := map[string]error{}
+		var tree *Tree
+		tree, results["ReBuildTree"] = ReBuildTree(bytes.NewReader(Case.data), unMarshal)
+		_, results["ReBuildTreeParallel"] = ReBuildTreeParallel(bytes.NewReader(Case.data), unMarshal, 2)
+		var count int
+		count, results["ValidateStream"] = ValidateStream(bytes.NewReader(Case.data))
+		for name, err := range results {
+			if Case.offset < 0 {
+				if err != nil {
+					t.Errorf("%s unexpected error %v", name, err)
+				}
+				continue
+			}
+			var streamErr *StreamError
+			if errors.As(err, &streamErr) == false || errors.Is(err, ErrEmptyPrefix) == false {
+				t.Errorf("%s unexpected error %v", name, err)
+			} else if streamErr.Offset != Case.offset {
+				t.Errorf("%s offset %d expect %d", name, streamErr.Offset, Case.offset)
+			}
+		}
+		if Case.offset < 0 && (count != Case.count || tree.Len() != Case.count) {
+			t.Errorf("count %d len %d expect %d", count, tree.Len(), Case.count)
+		}
+	}
+}
+
+func TestLongestCommonPrefix(t *testing.T) {
+	for _, Case := range []struct {
+		keys   []string
+		expect string
+	}{
+		{keys: nil, expect: ""},
+		{keys: []string{"abc"}, expect: "abc"},
+		{keys: []string{"ab", "abcd", "abce"}, expect: "ab"},
+		{keys: []string{"abcd", "abce", "abcdef"}, expect: "abc"},
+		{keys: []string{"abc", "b"}, expect: ""},
+		{keys: []string{"", "abc", "abd"}, expect: ""},
+	} {
+		tree := New()
+		for _, key := range Case.keys {
+			tree.Insert([]byte(key))
+		}
+		prefix := tree.LongestCommonPrefix()
+		if string(prefix) != Case.expect {
+			t.Errorf("no match \n%+v\n%+v\n", Case.expect, string(prefix))
+		}
+		if len(prefix) != 0 {
+			prefix[0] = 'x'
+			if tree.Has([]byte(Case.keys[0])) == false {
+				t.Errorf("prefix shares tree memory")
+			}
+		}
+	}
+}
+
+func TestReBuildTreeParallel(t *testing.T) {
+	unMarshal := func(data []byte) (interface{}, error) {
+		return string(data), nil
+	}
+	tree := New()
+	tree.ReplaceOrInsert(nil, "empty")
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprint(i * 7919 % 10007)
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	data := writeToBytes(t, tree)
+	expect, err := ReBuildTree(bytes.NewReader(data), unMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 3, 8} {
+		rebuilt, err := ReBuildTreeParallel(bytes.NewReader(data), unMarshal, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rebuilt.Len() != expect.Len() || bytes.Equal(writeToBytes(t, expect), writeToBytes(t, rebuilt)) == false {
+			t.Errorf("workers %d no match %d %d", workers, expect.Len(), rebuilt.Len())
+		}
+	}
+	if _, err := ReBuildTreeParallel(bytes.NewReader(data), unMarshal, 0); err == nil {
+		t.Errorf("expect error for zero workers")
+	}
+
+	underflow := streamHeader()
+	underflow.WriteByte(Pop)
+	sealStream(underflow)
+	emptyPrefix := streamHeader()
+	writeStreamNode(emptyPrefix, "a", Empty)
+	writeStreamNode(emptyPrefix, "", Empty)
+	emptyPrefix.WriteByte(Pop)
+	emptyPrefix.WriteByte(Pop)
+	sealStream(emptyPrefix)
+	for _, Case := range []struct {
+		data []byte
+		err  error
+	}{
+		{data: data[:len(data)-5], err: ErrNoChecksum},
+		{data: underflow.Bytes(), err: ErrStackError},
+		{data: emptyPrefix.Bytes(), err: ErrEmptyPrefix},
+	} {
+		if _, err := ReBuildTreeParallel(bytes.NewReader(Case.data), unMarshal, 4); errors.Is(err, Case.err) == false {
+			t.Errorf("no match \n%+v\n%+v\n", Case.err, err)
+		}
+	}
+}
+
+/*
+1 cpu,every key under one top level "/" subtree,so nothing runs in parallel
+BenchmarkReBuildTree         	       6	 198213511 ns/op	75074954 B/op	 2339746 allocs/op
+BenchmarkReBuildTreeParallel 	       4	 293946691 ns/op	254666848 B/op	 2339204 allocs/op
+*/
+func benchmarkReBuildTree(b *testing.B, rebuild func(reader io.Reader) (*Tree, error)) {
+	f, err := os.Open("rtree.stack.gz")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rebuild(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReBuildTree(b *testing.B) {
+	benchmarkReBuildTree(b, func(reader io.Reader) (*Tree, error) {
+		return ReBuildTree(reader, func(data []byte) (interface{}, error) {
+			return data, nil
+		})
+	})
+}
+
+func BenchmarkReBuildTreeParallel(b *testing.B) {
+	benchmarkReBuildTree(b, func(reader io.Reader) (*Tree, error) {
+		return ReBuildTreeParallel(reader, func(data []byte) (interface{}, error) {
+			return data, nil
+		}, runtime.GOMAXPROCS(0))
+	})
+}
+
+func TestWalkFunc(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"a", "ab", "abc", "abd", "b", "bc", "c"} {
+		tree.Insert([]byte(key))
+	}
+	for _, Case := range []struct {
+		actions map[string]WalkAction
+		expect  []string
+	}{
+		{actions: nil, expect: []string{"a", "ab", "abc", "abd", "b", "bc", "c"}},
+		{actions: map[string]WalkAction{"ab": SkipSubtree}, expect: []string{"a", "ab", "b", "bc", "c"}},
+		{actions: map[string]WalkAction{"a": SkipSubtree, "b": SkipSubtree}, expect: []string{"a", "b", "c"}},
+		{actions: map[string]WalkAction{"abc": Stop}, expect: []string{"a", "ab", "abc"}},
+		{actions: map[string]WalkAction{"ab": SkipSubtree, "bc": Stop}, expect: []string{"a", "ab", "b", "bc"}},
+	} {
+		var result []string
+		tree.WalkFunc(func(key []byte, value interface{}) WalkAction {
+			result = append(result, string(key))
+			return Case.actions[string(key)]
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("no match \n%+v\n%+v\n", Case.expect, result)
+		}
+	}
+
+	tree.Insert(nil)
+	var result []string
+	tree.WalkFunc(func(key []byte, value interface{}) WalkAction {
+		result = append(result, string(key))
+		return SkipSubtree
+	})
+	if reflect.DeepEqual([]string{""}, result) == false {
+		t.Errorf("skip below empty key %+v", result)
+	}
+}
+
+func TestWalkPrefixStripped(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"users/123/name", "users/123/mail", "users/124", "users/1", "groups"} {
+		tree.Insert([]byte(key))
+	}
+	for _, Case := range []struct {
+		prefix string
+		expect []string
+	}{
+		{prefix: "users/123/", expect: []string{"mail", "name"}},
+		{prefix: "users/12", expect: []string{"3/mail", "3/name", "4"}},
+		{prefix: "users/123/n", expect: []string{"ame"}},
+		{prefix: "users/1", expect: []string{"", "23/mail", "23/name", "24"}},
+		{prefix: "users/2", expect: nil},
+		{prefix: "", expect: []string{"groups", "users/1", "users/123/mail", "users/123/name", "users/124"}},
+	} {
+		var result []string
+		tree.WalkPrefixStripped([]byte(Case.prefix), func(relKey []byte, value interface{}) bool {
+			result = append(result, string(relKey))
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("no match \n%+v\n%+v\n", Case.expect, result)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	newTree := func() *Tree {
+		tree := New()
+		for _, key := range []string{"ab", "abc", "abd", "b"} {
+			tree.Insert([]byte(key))
+		}
+		return tree
+	}
+	if err := newTree().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, Case := range []struct {
+		name    string
+		corrupt func(tree *Tree)
+	}{
+		{name: "unsorted", corrupt: func(tree *Tree) {
+			tree.children[0], tree.children[1] = tree.children[1], tree.children[0]
+		}},
+		{name: "duplicate", corrupt: func(tree *Tree) {
+			tree.children[1].prefix = []byte("a")
+		}},
+		{name: "empty prefix", corrupt: func(tree *Tree) {
+			tree.children[0].children[0].prefix = nil
+		}},
+		{name: "unmerged", corrupt: func(tree *Tree) {
+			tree.children[0].value = nil
+			tree.children[0].children = tree.children[0].children[:1]
+			tree.count -= 2
+		}},
+		{name: "empty node", corrupt: func(tree *Tree) {
+			tree.children[1].value = nil
+			tree.count--
+		}},
+		{name: "count", corrupt: func(tree *Tree) {
+			tree.count++
+		}},
+	} {
+		tree := newTree()
+		Case.corrupt(tree)
+		if err := tree.Validate(); err == nil {
+			t.Errorf("%s not detected", Case.name)
+		}
+	}
+}
+
+func TestDeleteExhaustive(t *testing.T) {
+	// every subset of the keys of up to two segments over three segments,
+	// giving nodes of 1,2 and 3 children with and without values
+	segments := []string{"a", "bb", "ccc"}
+	var keys []string
+	for _, first := range segments {
+		keys = append(keys, first)
+		for _, second := range segments {
+			keys = append(keys, first+second)
+		}
+	}
+	for set := 0; set < 1<<len(keys); set++ {
+		var inserts []string
+		for i, key := range keys {
+			if set&(1<<i) != 0 {
+				inserts = append(inserts, key)
+			}
+		}
+		tree := New()
+		for _, key := range inserts {
+			tree.ReplaceOrInsert([]byte(key), key)
+		}
+		for i, key := range inserts {
+			clone := tree.Clone()
+			if value, ok := clone.DeleteReturning([]byte(key)); ok == false || value != key {
+				t.Fatalf("%+v delete %s: %v %v", inserts, key, value, ok)
+			}
+			expect := append(append([]string{}, inserts[:i]...), inserts[i+1:]...)
+			if err := clone.Validate(); err != nil {
+				t.Fatalf("%+v delete %s: %v", inserts, key, err)
+			}
+			for _, key := range expect {
+				if value, ok := clone.Get([]byte(key)); ok == false || value != key {
+					t.Fatalf("%+v delete %s lost %s", inserts, key, key)
+				}
+			}
+			if clone.Len() != len(expect) {
+				t.Fatalf("%+v delete %s Len %d", inserts, key, clone.Len())
+			}
+		}
+		for len(inserts) != 0 {
+			// delete from the middle until empty
+			key := inserts[len(inserts)/2]
+			inserts = append(inserts[:len(inserts)/2], inserts[len(inserts)/2+1:]...)
+			tree.Delete([]byte(key))
+			if err := tree.Validate(); err != nil {
+				t.Fatalf("delete %s: %v", key, err)
+			}
+			for _, key := range inserts {
+				if value, ok := tree.Get([]byte(key)); ok == false || value != key {
+					t.Fatalf("delete lost %s", key)
+				}
+			}
+		}
+	}
+}
+
+func TestDeleteBelowGhostNode(t *testing.T) {
+	// "a" is a value-less node with a single child,as ReBuildTree may leave
+	buffer := streamHeader()
+	writeStreamNode(buffer, "a", nil)
+	writeStreamNode(buffer, "b", Empty)
+	buffer.WriteByte(Pop)
+	buffer.WriteByte(Pop)
+	writeStreamNode(buffer, "c", Empty)
+	buffer.WriteByte(Pop)
+	sealStream(buffer)
+	tree, err := ReBuildTree(buffer, func(data []byte) (interface{}, error) {
+		return data, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Delete([]byte("ab"))
+	if err := tree.Validate(); err != nil {
+		t.Error(err)
+	}
+	if reflect.DeepEqual([]string{"c"}, treeKeys(tree)) == false {
+		t.Errorf("no match %+v", treeKeys(tree))
+	}
+}
+
+type taggedPoint struct {
+	X, Y int
+}
+
+// the registry is global,so register once across -count runs
+var registerTaggedTypes sync.Once
+
+func TestTaggedValues(t *testing.T) {
+	registerTaggedTypes.Do(func() {
+		if err := RegisterValueType(1, "", func(value interface{}) ([]byte, error) {
+			return []byte(value.(string)), nil
+		}, func(data []byte) (interface{}, error) {
+			return string(data), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterValueType(2, taggedPoint{}, func(value interface{}) ([]byte, error) {
+			point := value.(taggedPoint)
+			return []byte(fmt.Sprintf("%d,%d", point.X, point.Y)), nil
+		}, func(data []byte) (interface{}, error) {
+			var point taggedPoint
+			_, err := fmt.Sscanf(string(data), "%d,%d", &point.X, &point.Y)
+			return point, err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterValueType(1, 0, nil, nil); err == nil {
+			t.Errorf("expect error for duplicate tag")
+		}
+		if err := RegisterValueType(3, "", nil, nil); err == nil {
+			t.Errorf("expect error for duplicate type")
+		}
+	})
+
+	tree := New()
+	tree.ReplaceOrInsert([]byte("a"), "alpha")
+	tree.ReplaceOrInsert([]byte("ab"), taggedPoint{X: 1, Y: -2})
+	tree.ReplaceOrInsert([]byte("b"), "beta")
+	tree.ReplaceOrInsert(nil, taggedPoint{X: 3})
+	var buffer bytes.Buffer
+	if _, err := tree.WriteToTagged(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := ReBuildTreeTagged(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(tree.ToMap(), rebuilt.ToMap()) == false {
+		t.Errorf("no match \n%+v\n%+v\n", tree.ToMap(), rebuilt.ToMap())
+	}
+
+	tree.ReplaceOrInsert([]byte("c"), 1.5)
+	if _, err := tree.WriteToTagged(&buffer); err == nil {
+		t.Errorf("expect error for unregistered type")
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	tree := New()
+	last := tree.MemoryUsage()
+	for i := 0; i < 1000; i++ {
+		tree.ReplaceOrInsert([]byte(fmt.Sprint(i*7919%10007)), fmt.Sprint(i))
+		// a key landing on an existing split node adds no memory
+		usage := tree.MemoryUsage()
+		if usage < last {
+			t.Fatalf("usage %d after %d inserts,was %d", usage, i+1, last)
+		}
+		last = usage
+	}
+	if first := New().MemoryUsage(); last <= first {
+		t.Errorf("usage %d not above empty tree %d", last, first)
+	}
+	if usage := tree.MemoryUsage(); usage != last {
+		t.Errorf("usage %d expect %d", usage, last)
+	}
+	valueSize := func(value interface{}) int64 {
+		return int64(len(value.(string)))
+	}
+	var values int64
+	for _, value := range tree.Values() {
+		values += valueSize(value)
+	}
+	if usage := tree.MemoryUsageWithValues(valueSize); usage != last+values {
+		t.Errorf("usage with values %d expect %d", usage, last+values)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	inserts := []string{"", "a", "ab", "abc", "abd", "ac", "b", "bcd", "bce", "c"}
+	for n := -1; n <= len(inserts)+1; n++ {
+		for _, head := range []bool{true, false} {
+			tree := New()
+			for _, key := range inserts {
+				tree.Insert([]byte(key))
+			}
+			clone := tree.Clone()
+			var deleted int
+			var expect []string
+			keep := n
+			if keep < 0 {
+				keep = 0
+			} else if keep > len(inserts) {
+				keep = len(inserts)
+			}
+			if head {
+				deleted = tree.TruncateHead(n)
+				expect = inserts[:keep]
+			} else {
+				deleted = tree.TruncateTail(n)
+				expect = inserts[len(inserts)-keep:]
+			}
+			if deleted != len(inserts)-keep || tree.Len() != keep {
+				t.Errorf("head %v n %d deleted %d Len %d", head, n, deleted, tree.Len())
+			}
+			if result := tree.Keys(); len(result) != len(expect) || fmt.Sprintf("%s", result) != fmt.Sprint(expect) {
+				t.Errorf("head %v n %d no match \n%+v\n%s\n", head, n, expect, result)
+			}
+			if err := tree.Validate(); err != nil {
+				t.Errorf("head %v n %d: %v", head, n, err)
+			}
+			if clone.Len() != len(inserts) || clone.Validate() != nil {
+				t.Errorf("clone changed head %v n %d", head, n)
+			}
+		}
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	inserts := []string{"", "abc", "abcd", "abd", "b", "bcdef", "bcx", "d"}
+	tree := New()
+	for _, key := range inserts {
+		tree.Insert([]byte(key))
+	}
+	for _, Case := range []struct {
+		seek   string
+		expect []string
+	}{
+		{seek: "", expect: inserts},
+		{seek: "abc", expect: inserts[1:]},
+		{seek: "abcd", expect: inserts[2:]},
+		{seek: "ab", expect: inserts[1:]},
+		{seek: "abca", expect: inserts[2:]},
+		{seek: "abcz", expect: inserts[3:]},
+		{seek: "abe", expect: inserts[4:]},
+		{seek: "bcd", expect: inserts[5:]},
+		{seek: "bcdeg", expect: inserts[6:]},
+		{seek: "bcdee", expect: inserts[5:]},
+		{seek: "bca", expect: inserts[5:]},
+		{seek: "c", expect: inserts[7:]},
+		{seek: "\x00", expect: inserts[1:]},
+		{seek: "e", expect: nil},
+	} {
+		it := tree.Iterator()
+		it.Next()
+		it.Seek([]byte(Case.seek))
+		var result []string
+		for it.Next() {
+			result = append(result, string(it.Key()))
+		}
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("seek %q no match \n%+v\n%+v\n", Case.seek, Case.expect, result)
+		}
+	}
+}
+
+func TestFoldTree(t *testing.T) {
+	tree := NewFold()
+	tree.ReplaceOrInsert([]byte("Foo"), 1)
+	if old := tree.ReplaceOrInsert([]byte("foo"), 2); old != 1 {
+		t.Errorf("foo replaced %v", old)
+	}
+	tree.Insert([]byte("Example.COM"))
+	tree.ReplaceOrInsert([]byte("bar"), 3)
+	tree.ReplaceOrInsert([]byte("Ä"), 4)
+	if tree.Len() != 4 {
+		t.Errorf("Len %d", tree.Len())
+	}
+	if value, ok := tree.Get([]byte("FOO")); ok == false || value != 2 {
+		t.Errorf("Get FOO %v %v", value, ok)
+	}
+	if tree.Find([]byte("example.com")) == false || tree.Has([]byte("EXAMPLE.com")) == false {
+		t.Errorf("example.com not found")
+	}
+	if tree.Has([]byte("ä")) {
+		t.Errorf("non ASCII folded")
+	}
+	var result []string
+	tree.Walk(func(key []byte, value interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if expect := []string{"bar", "Example.COM", "foo", "Ä"}; reflect.DeepEqual(expect, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, result)
+	}
+	result = nil
+	tree.AscendRange([]byte("BAR"), []byte("FOO"), func(key []byte, value interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if expect := []string{"bar", "Example.COM"}; reflect.DeepEqual(expect, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, result)
+	}
+	result = nil
+	tree.DescendRange([]byte("FOO"), []byte("BAR"), func(key []byte, value interface{}) bool {
+		result = append(result, string(key))
+		return true
+	})
+	if expect := []string{"foo", "Example.COM"}; reflect.DeepEqual(expect, result) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, result)
+	}
+	tree.Delete([]byte("FoO"))
+	if tree.Has([]byte("foo")) || tree.Len() != 3 {
+		t.Errorf("foo not deleted")
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	tree, expect := New(), New()
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprint(i * 7919 % 10007))
+		tree.Insert(key)
+		expect.Insert(key)
+	}
+	tree.Insert(nil)
+	expect.Insert(nil)
+	clone := tree.Clone()
+	var keys [][]byte
+	for i := 0; i < 3000; i += 3 {
+		key := []byte(fmt.Sprint(i * 7919 % 10007))
+		keys = append(keys, key, key)
+	}
+	keys = append(keys, []byte("absent"), nil, []byte{})
+	var deleted int
+	for _, key := range keys {
+		if _, ok := expect.DeleteReturning(key); ok {
+			deleted++
+		}
+	}
+	if count := tree.DeleteMany(keys); count != deleted {
+		t.Errorf("DeleteMany count %d expect %d", count, deleted)
+	}
+	if bytes.Equal(writeToBytes(t, expect), writeToBytes(t, tree)) == false || tree.Len() != expect.Len() {
+		t.Errorf("no match %d %d", expect.Len(), tree.Len())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Error(err)
+	}
+	if clone.Len() != 2001 || clone.Validate() != nil {
+		t.Errorf("clone changed %d", clone.Len())
+	}
+	if count := tree.DeleteMany(tree.Keys()); count != expect.Len() || tree.Len() != 0 || len(tree.children) != 0 {
+		t.Errorf("delete all %d %d", count, tree.Len())
+	}
+}
+
+/*
+every 4th key of files.txt,deleted on a Clone so nodes are copied on the way down.
+freed nodes are returned at the end,so DeleteMany misses the FreeList more often
+BenchmarkDeleteLoop 	      18	  78717630 ns/op	10635322 B/op	  297948 allocs/op
+BenchmarkDeleteMany 	      18	  66069828 ns/op	18007549 B/op	  348042 allocs/op
+*/
+func benchmarkDeleteMany(b *testing.B, deleteKeys func(tree *Tree, keys [][]byte)) {
+	tree := loadFilesTree(b)
+	var keys [][]byte
+	for i, key := range sortedFileKeys(b) {
+		if i%4 == 0 {
+			keys = append(keys, key)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		deleteKeys(tree.Clone(), keys)
+	}
+}
+
+func BenchmarkDeleteLoop(b *testing.B) {
+	benchmarkDeleteMany(b, func(tree *Tree, keys [][]byte) {
+		for _, key := range keys {
+			tree.Delete(key)
+		}
+	})
+}
+
+func BenchmarkDeleteMany(b *testing.B) {
+	benchmarkDeleteMany(b, func(tree *Tree, keys [][]byte) {
+		tree.DeleteMany(keys)
+	})
+}
+
+func TestWalkFrom(t *testing.T) {
+	inserts := []string{"", "abc", "abcd", "abd", "b", "bcdef", "bcx", "d"}
+	tree := New()
+	for _, key := range inserts {
+		tree.Insert([]byte(key))
+	}
+	for _, Case := range []struct {
+		start  string
+		expect []string
+	}{
+		{start: "", expect: inserts},
+		{start: "abc", expect: inserts[1:]},
+		{start: "abca", expect: inserts[2:]},
+		{start: "abe", expect: inserts[4:]},
+		{start: "bcdee", expect: inserts[5:]},
+		{start: "bcdeg", expect: inserts[6:]},
+		{start: "d", expect: inserts[7:]},
+		{start: "d\x00", expect: nil},
+	} {
+		var result []string
+		tree.WalkFrom([]byte(Case.start), func(key []byte, value interface{}) bool {
+			result = append(result, string(key))
+			return true
+		})
+		if reflect.DeepEqual(Case.expect, result) == false {
+			t.Errorf("start %q no match \n%+v\n%+v\n", Case.start, Case.expect, result)
+		}
+	}
+
+	// pages of 3,resuming after the last key returned
+	var pages [][]string
+	var last []byte
+	for {
+		var page []string
+		start := last
+		if last != nil {
+			start = append(append([]byte{}, last...), 0)
+		}
+		tree.WalkFrom(start, func(key []byte, value interface{}) bool {
+			page = append(page, string(key))
+			last = append(last[:0], key...)
+			return len(page) < 3
+		})
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+	}
+	expect := [][]string{inserts[:3], inserts[3:6], inserts[6:]}
+	if reflect.DeepEqual(expect, pages) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, pages)
+	}
+}
+
+func TestMapValues(t *testing.T) {
+	tree := New()
+	for i, key := range []string{"", "a", "ab", "abc", "abd", "b", "bc"} {
+		tree.ReplaceOrInsert([]byte(key), i)
+	}
+	clone := tree.Clone()
+	expect := clone.ToMap()
+	tree.MapValues(func(key []byte, old interface{}) interface{} {
+		// drop the odd values
+		if old.(int)%2 == 1 {
+			return DeleteValue
+		}
+		return fmt.Sprintf("%s=%d", key, old)
+	})
+	if result := tree.ToMap(); reflect.DeepEqual(map[string]interface{}{
+		"": "=0", "ab": "ab=2", "abd": "abd=4", "bc": "bc=6",
+	}, result) == false {
+		t.Errorf("no match %+v", result)
+	}
+	if tree.Len() != 4 {
+		t.Errorf("Len %d", tree.Len())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Error(err)
+	}
+	if reflect.DeepEqual(expect, clone.ToMap()) == false || clone.Len() != 7 {
+		t.Errorf("clone changed %+v", clone.ToMap())
+	}
+
+	// a nil stored by Set reads as nil and survives the identity mapping
+	nils := New()
+	nils.Set([]byte("a"), nil)
+	nils.Set(nil, nil)
+	nils.ReplaceOrInsert([]byte("b"), 1)
+	var olds []interface{}
+	nils.MapValues(func(key []byte, old interface{}) interface{} {
+		olds = append(olds, old)
+		return old
+	})
+	if expect := []interface{}{nil, nil, 1}; reflect.DeepEqual(expect, olds) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, olds)
+	}
+	for _, key := range []string{"", "a", "b"} {
+		if value, ok := nils.Get([]byte(key)); ok == false || (key != "b" && value != nil) {
+			t.Errorf("Get %q %v %v", key, value, ok)
+		}
+	}
+	nils.MapValues(func(key []byte, old interface{}) interface{} {
+		return nil
+	})
+	if value, ok := nils.Get([]byte("b")); ok == false || value != nil || nils.Len() != 3 {
+		t.Errorf("Get b %v %v Len %d", value, ok, nils.Len())
+	}
+}
+
+func TestFilterInto(t *testing.T) {
+	tree := New()
+	for i, key := range []string{"", "docs/a.md", "docs/b.txt", "src/main.go", "src/main_test.go", "README.md"} {
+		tree.ReplaceOrInsert([]byte(key), i)
+	}
+	before := writeToBytes(t, tree)
+	result := tree.FilterInto(func(key []byte, value interface{}) bool {
+		return bytes.HasSuffix(key, []byte(".md")) || value == 0
+	})
+	if expect := map[string]interface{}{"": 0, "docs/a.md": 1, "README.md": 5}; reflect.DeepEqual(expect, result.ToMap()) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, result.ToMap())
+	}
+	if result.Len() != 3 {
+		t.Errorf("Len %d", result.Len())
+	}
+	result.Delete([]byte("docs/a.md"))
+	result.ReplaceOrInsert([]byte("docs/c.md"), 6)
+	if bytes.Equal(before, writeToBytes(t, tree)) == false {
+		t.Errorf("source changed")
+	}
+}
+
+func TestIsMember(t *testing.T) {
+	tree := New()
+	tree.Insert([]byte("set"))
+	tree.Insert(nil)
+	tree.ReplaceOrInsert([]byte("map"), []byte("empty"))
+	tree.ReplaceOrInsert([]byte("other"), 1)
+	for key, expect := range map[string]bool{"set": true, "": true, "map": false, "other": false, "absent": false} {
+		if tree.IsMember([]byte(key)) != expect {
+			t.Errorf("IsMember %q expect %v", key, expect)
+		}
+	}
+
+	var marshaled []string
+	var buffer bytes.Buffer
+	if _, err := tree.WriteTo(&buffer, func(obj interface{}) ([]byte, error) {
+		if IsEmpty(obj) {
+			t.Errorf("Empty marshaled")
+		}
+		marshaled = append(marshaled, fmt.Sprint(obj))
+		if data, ok := obj.([]byte); ok {
+			return data, nil
+		}
+		return []byte(fmt.Sprint(obj)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(marshaled) != 2 || bytes.Count(buffer.Bytes(), Empty) != 1 {
+		t.Errorf("members written as values %+v", marshaled)
+	}
+	data := buffer.Bytes()
+	unMarshal := func(data []byte) (interface{}, error) {
+		return data, nil
+	}
+	for _, rebuild := range []func() (*Tree, error){
+		func() (*Tree, error) { return ReBuildTree(bytes.NewReader(data), unMarshal) },
+		func() (*Tree, error) { return ReBuildTreeParallel(bytes.NewReader(data), unMarshal, 2) },
+	} {
+		rebuilt, err := rebuild()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rebuilt.Len() != 4 || rebuilt.IsMember([]byte("set")) == false || rebuilt.IsMember(nil) == false ||
+			rebuilt.IsMember([]byte("map")) {
+			t.Errorf("membership lost %+v", rebuilt.ToMap())
+		}
+	}
+	members := map[string]bool{}
+	if err := StreamKeys(bytes.NewReader(data), unMarshal, func(key []byte, value interface{}) bool {
+		members[string(key)] = IsEmpty(value)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expect := map[string]bool{"": true, "map": false, "other": false, "set": true}; reflect.DeepEqual(expect, members) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, members)
+	}
+	if count, err := ValidateStream(bytes.NewReader(data)); err != nil || count != 4 {
+		t.Errorf("ValidateStream %d %v", count, err)
+	}
+
+	// version 2 streams carry members as plain values
+	tree = New()
+	tree.ReplaceOrInsert([]byte("a"), []byte("value"))
+	data = writeToBytes(t, tree)
+	data[len(streamMagic)] = 2
+	if rebuilt, err := ReBuildTree(bytes.NewReader(data), unMarshal); err != nil || rebuilt.Len() != 1 {
+		t.Errorf("version 2 stream %v", err)
+	}
+}
+
+func TestShardedTree(t *testing.T) {
+	if _, err := NewShardedTree(0); err == nil {
+		t.Errorf("expect error for zero shards")
+	}
+	sharded, err := NewShardedTree(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 2000; i += 4 {
+				key := []byte(fmt.Sprint(i * 7919 % 10007))
+				sharded.ReplaceOrInsert(key, i)
+				if i%3 == 0 {
+					sharded.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	sharded.Insert(nil)
+
+	expect := New()
+	for i := 0; i < 2000; i++ {
+		if i%3 != 0 {
+			expect.ReplaceOrInsert([]byte(fmt.Sprint(i*7919%10007)), i)
+		}
+	}
+	expect.Insert(nil)
+	if sharded.Len() != expect.Len() {
+		t.Errorf("Len %d expect %d", sharded.Len(), expect.Len())
+	}
+	var keys [][]byte
+	sharded.Walk(func(key []byte, value interface{}) bool {
+		if v, ok := expect.Get(key); ok == false || fmt.Sprint(v) != fmt.Sprint(value) {
+			t.Errorf("%s: %v expect %v", key, value, v)
+		}
+		keys = append(keys, bytesCopy(key))
+		return true
+	})
+	if reflect.DeepEqual(expect.Keys(), keys) == false {
+		t.Errorf("Walk out of order")
+	}
+	if sharded.Find([]byte("3")) != expect.Has([]byte("3")) {
+		t.Errorf("Find 3")
+	}
+}
+
+/*
+1 cpu,so the shards can't run writers in parallel
+go test -race -run xxx -bench 'ParallelWrite'
+BenchmarkSyncTreeParallelWrite 	  206874	      9721 ns/op
+BenchmarkShardedParallelWrite  	  180163	      9261 ns/op
+*/
+func BenchmarkSyncTreeParallelWrite(b *testing.B) {
+	tree := NewSyncTree()
+	benchmarkParallelWrite(b, func(key []byte, value interface{}) {
+		tree.ReplaceOrInsert(key, value)
+	})
+}
+
+func BenchmarkShardedParallelWrite(b *testing.B) {
+	tree, err := NewShardedTree(16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkParallelWrite(b, func(key []byte, value interface{}) {
+		tree.ReplaceOrInsert(key, value)
+	})
+}
+
+func benchmarkParallelWrite(b *testing.B, write func(key []byte, value interface{})) {
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			i++
+			write([]byte(strconv.Itoa(i*7919%1000003)), i)
+		}
+	})
+}
+
+func TestSetNil(t *testing.T) {
+	tree := New()
+	tree.StartRecording()
+	tree.Set([]byte("nil"), nil)
+	tree.Set([]byte("nil/child"), 1)
+	tree.Set(nil, nil)
+	tree.ReplaceOrInsert([]byte("ignored"), nil)
+	tree.Set([]byte("value"), 2)
+	ops := tree.StopRecording()
+	if tree.Len() != 4 || tree.Has([]byte("ignored")) {
+		t.Errorf("Len %d %+v", tree.Len(), tree.ToMap())
+	}
+	for _, key := range []string{"nil", ""} {
+		if value, ok := tree.Get([]byte(key)); ok == false || value != nil {
+			t.Errorf("Get %q %v %v", key, value, ok)
+		}
+	}
+	expect := map[string]interface{}{"": nil, "nil": nil, "nil/child": 1, "value": 2}
+	if reflect.DeepEqual(expect, tree.ToMap()) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, tree.ToMap())
+	}
+	walked := map[string]interface{}{}
+	tree.WalkKeys(func(key []byte, value interface{}) bool {
+		walked[string(key)] = value
+		return true
+	})
+	if reflect.DeepEqual(expect, walked) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, walked)
+	}
+	if replayed := ReplayOps(ops); reflect.DeepEqual(expect, replayed.ToMap()) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, replayed.ToMap())
+	}
+
+	var buffer bytes.Buffer
+	if _, err := tree.WriteTo(&buffer, func(obj interface{}) ([]byte, error) {
+		if obj == nil {
+			t.Errorf("nil marshaled")
+		}
+		return []byte(fmt.Sprint(obj)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	unMarshal := func(data []byte) (interface{}, error) {
+		value, err := strconv.Atoi(string(data))
+		return value, err
+	}
+	for _, rebuild := range []func() (*Tree, error){
+		func() (*Tree, error) { return ReBuildTree(bytes.NewReader(data), unMarshal) },
+		func() (*Tree, error) { return ReBuildTreeParallel(bytes.NewReader(data), unMarshal, 2) },
+	} {
+		rebuilt, err := rebuild()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(expect, rebuilt.ToMap()) == false || rebuilt.Len() != 4 {
+			t.Errorf("no match \n%+v\n%+v\n", expect, rebuilt.ToMap())
+		}
+		if err := rebuilt.Validate(); err != nil {
+			t.Error(err)
+		}
+	}
+	streamed := map[string]interface{}{}
+	if err := StreamKeys(bytes.NewReader(data), unMarshal, func(key []byte, value interface{}) bool {
+		streamed[string(key)] = value
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(expect, streamed) == false {
+		t.Errorf("no match \n%+v\n%+v\n", expect, streamed)
+	}
+	if count, err := ValidateStream(bytes.NewReader(data)); err != nil || count != 4 {
+		t.Errorf("ValidateStream %d %v", count, err)
+	}
+
+	if value, ok := tree.DeleteReturning([]byte("nil")); value != nil || ok == false || tree.Has([]byte("nil")) || tree.Len() != 3 {
+		t.Errorf("Delete nil %v %v %d", value, ok, tree.Len())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteKeys(t *testing.T) {
+	keys := []string{"", "ab", "abc", "abd", "b", "bcd"}
+	tree := New()
+	for _, key := range []string{"abc", "abd", "ab", "b", "bcd"} {
+		tree.Insert([]byte(key))
+	}
+	tree.Set(nil, nil)
+	for _, Case := range []struct {
+		sep, terminator string
+	}{
+		{"\n", "\n"},
+		{"|", "\n"},
+		{",", ""},
+		{"", ""},
+	} {
+		expect := strings.Join(keys, Case.sep) + Case.terminator
+		var buffer bytes.Buffer
+		size, err := tree.WriteKeys(&buffer, []byte(Case.sep), []byte(Case.terminator))
+		if err != nil || size != int64(buffer.Len()) {
+			t.Errorf("WriteKeys %d %v", size, err)
+		}
+		if expect != buffer.String() {
+			t.Errorf("no match \n%q\n%q\n", expect, buffer.String())
+		}
+	}
+
+	var buffer bytes.Buffer
+	if size, err := New().WriteKeys(&buffer, []byte("\n"), []byte("\n")); err != nil || size != 0 {
+		t.Errorf("empty tree WriteKeys %d %v %q", size, err, buffer.String())
+	}
+
+	writer := &limitWriter{limit: 8}
+	size, err := tree.WriteKeys(writer, []byte("\n"), []byte("\n"))
+	if err != errLimit || size != 8 {
+		t.Errorf("WriteKeys %d %v", size, err)
+	}
+}
+
+var errLimit = fmt.Errorf("write limit")
+
+type limitWriter struct {
+	limit int
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errLimit
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+/*
+files.txt,200k keys into a bytes.Buffer
+BenchmarkWalkJoinWrite 	      10	 113350264 ns/op	72265243 B/op	  600001 allocs/op
+BenchmarkWriteKeys     	      99	  12601872 ns/op	  456443 B/op	    2244 allocs/op
+*/
+func BenchmarkWalkJoinWrite(b *testing.B) {
+	tree := loadFilesTree(b)
+	var buffer bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+		tree.Walk(func(prefixes [][]byte, _ interface{}) bool {
+			buffer.Write(append(bytes.Join(prefixes, nil), '\n'))
+			return true
+		})
+	}
+}
+
+func BenchmarkWriteKeys(b *testing.B) {
+	tree := loadFilesTree(b)
+	var buffer bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+		if _, err := tree.WriteKeys(&buffer, []byte("\n"), []byte("\n")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCloneIndependentFreeList(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.ReplaceOrInsert([]byte(fmt.Sprint(i)), i)
+	}
+	expect := tree.ToMap()
+	clone := tree.CloneIndependentFreeList()
+	if clone.cow.freelist == tree.cow.freelist || clone.cow.childrenFreeList == tree.cow.childrenFreeList {
+		t.Errorf("pools shared")
+	}
+	if shared := tree.Clone(); shared.cow.freelist != tree.cow.freelist {
+		t.Errorf("Clone pools not shared")
+	}
+	hits, misses, returns := tree.cow.freelist.Stats()
+	for i := 0; i < 1000; i += 2 {
+		clone.Delete([]byte(fmt.Sprint(i)))
+		clone.ReplaceOrInsert([]byte(fmt.Sprint(i, "x")), i)
+	}
+	if h, m, r := tree.cow.freelist.Stats(); h != hits || m != misses || r != returns {
+		t.Errorf("clone used the tree pool")
+	}
+	if reflect.DeepEqual(expect, tree.ToMap()) == false {
+		t.Errorf("tree changed by clone writes")
+	}
+	if clone.Len() != 1000 || clone.Has([]byte("0")) || clone.Has([]byte("0x")) == false {
+		t.Errorf("clone Len %d", clone.Len())
+	}
+	if err := clone.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+/*
+1 cpu,the two writers never run at once so the shared pool lock is never
+contended and both variants measure the same within noise,run with -cpu 2 or
+more to see the contention
+go test -run xxx -bench 'ConcurrentWrite' -count 3
+BenchmarkCloneConcurrentWrite                    	  876124	      1396 ns/op
+BenchmarkCloneConcurrentWrite                    	  744739	      1742 ns/op
+BenchmarkCloneConcurrentWrite                    	  809733	      1519 ns/op
+BenchmarkCloneIndependentFreeListConcurrentWrite 	  847197	      1508 ns/op
+BenchmarkCloneIndependentFreeListConcurrentWrite 	  756438	      1711 ns/op
+BenchmarkCloneIndependentFreeListConcurrentWrite 	  695524	      1697 ns/op
+*/
+func BenchmarkCloneConcurrentWrite(b *testing.B) {
+	benchmarkCloneConcurrentWrite(b, (*Tree).Clone)
+}
+
+func BenchmarkCloneIndependentFreeListConcurrentWrite(b *testing.B) {
+	benchmarkCloneConcurrentWrite(b, (*Tree).CloneIndependentFreeList)
+}
+
+// benchmarkCloneConcurrentWrite inserts and deletes keys in a tree and its
+// clone from two goroutines,cycling nodes through the pools
+func benchmarkCloneConcurrentWrite(b *testing.B, clone func(tree *Tree) *Tree) {
+	tree := New()
+	for i := 0; i < 10000; i++ {
+		tree.ReplaceOrInsert([]byte(strconv.Itoa(i*7919%100003)), i)
+	}
+	trees := []*Tree{tree, clone(tree)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for _, tree := range trees {
+		wg.Add(1)
+		go func(tree *Tree) {
+			defer wg.Done()
+			for i := 0; i < b.N; i++ {
+				key := []byte(strconv.Itoa(i*7919%100003) + "x")
+				tree.ReplaceOrInsert(key, i)
+				tree.Delete(key)
+			}
+		}(tree)
+	}
+	wg.Wait()
+}
+
+func TestDeleteRange(t *testing.T) {
+	inserts := []string{"", "a", "ab", "abc", "abd", "ac", "b", "bcd", "bce", "bcef", "c", "cab"}
+	// bounds on every key,between keys and splitting edges
+	bounds := append([]string{"aa", "abb", "abcd", "bc", "bcda", "bcf", "ca", "d", "\xff"}, inserts...)
+	for _, from := range bounds {
+		for _, to := range bounds {
+			tree := New()
+			for _, key := range inserts {
+				tree.Insert([]byte(key))
+			}
+			clone := tree.Clone()
+			var expect []string
+			for _, key := range inserts {
+				if key < from || key >= to {
+					expect = append(expect, key)
+				}
+			}
+			deleted := tree.DeleteRange([]byte(from), []byte(to))
+			if deleted != len(inserts)-len(expect) || tree.Len() != len(expect) {
+				t.Errorf("[%q, %q) deleted %d Len %d", from, to, deleted, tree.Len())
+			}
+			if result := tree.Keys(); fmt.Sprintf("%q", result) != fmt.Sprintf("%q", expect) {
+				t.Errorf("[%q, %q) no match \n%q\n%q\n", from, to, expect, result)
+			}
+			if err := tree.Validate(); err != nil {
+				t.Errorf("[%q, %q): %v", from, to, err)
+			}
+			if clone.Len() != len(inserts) || clone.Validate() != nil {
+				t.Errorf("clone changed [%q, %q)", from, to)
+			}
+		}
+	}
+
+	// whole subtrees go back to the pool
+	tree := NewWithFreeList(NewFreeList(2000))
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("%04d", i)))
+	}
+	_, _, returns := tree.cow.freelist.Stats()
+	if deleted := tree.DeleteRange([]byte("0100"), []byte("0900")); deleted != 800 || tree.Len() != 200 {
+		t.Errorf("deleted %d Len %d", deleted, tree.Len())
+	}
+	if _, _, after := tree.cow.freelist.Stats(); after-returns < 800 {
+		t.Errorf("%d nodes freed", after-returns)
+	}
+}
+
+func TestTreeWriter(t *testing.T) {
+	tree := New()
+	inserts := []string{"", "a", "ab", "abc", "abd", "ac", "b", "bcd", "bce", "bcef", "c", "cab"}
+	for _, key := range inserts {
+		tree.ReplaceOrInsert([]byte(key), key)
+	}
+	marshal := func(obj interface{}) ([]byte, error) {
+		return []byte(fmt.Sprint(obj)), nil
+	}
+	unMarshal := func(data []byte) (interface{}, error) {
+		return string(data), nil
+	}
+	for _, Case := range []struct {
+		prefixes []string
+		expect   []string
+	}{
+		{[]string{""}, inserts},
+		{[]string{"a", "b", "c"}, inserts[1:]},
+		{[]string{"ab", "ac", "bc", "c"}, []string{"ab", "abc", "abd", "ac", "bcd", "bce", "bcef", "c", "cab"}},
+		{[]string{"abc", "bce", "ca"}, []string{"abc", "bce", "bcef", "cab"}},
+		{[]string{"abd", "x"}, []string{"abd"}},
+		{[]string{"x"}, nil},
+		{nil, nil},
+	} {
+		var buffer bytes.Buffer
+		writer, err := NewTreeWriter(tree, &buffer, marshal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, prefix := range Case.prefixes {
+			if err := writer.WriteSubtree([]byte(prefix)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		rebuilt, err := ReBuildTree(bytes.NewReader(buffer.Bytes()), unMarshal)
+		if err != nil {
+			t.Fatalf("%+v: %v", Case.prefixes, err)
+		}
+		if result := rebuilt.Keys(); fmt.Sprintf("%q", result) != fmt.Sprintf("%q", Case.expect) {
+			t.Errorf("%+v no match \n%q\n%q\n", Case.prefixes, Case.expect, result)
+		}
+		rebuilt.Optimize()
+		if err := rebuilt.Validate(); err != nil {
+			t.Errorf("%+v: %v", Case.prefixes, err)
+		}
+		parallel, err := ReBuildTreeParallel(bytes.NewReader(buffer.Bytes()), unMarshal, 2)
+		if err != nil || reflect.DeepEqual(rebuilt.ToMap(), parallel.ToMap()) == false {
+			t.Errorf("%+v parallel %v", Case.prefixes, err)
+		}
+	}
+
+	// covering the tree gives the stream WriteTo writes
+	var buffer bytes.Buffer
+	writer, err := NewTreeWriter(tree, &buffer, marshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Delete([]byte("ab"))
+	for _, prefix := range []string{"a", "b", "c"} {
+		if err := writer.WriteSubtree([]byte(prefix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteSubtree([]byte("bz")); err == nil {
+		t.Errorf("out of order subtree written")
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree.ReplaceOrInsert([]byte("ab"), "ab")
+	tree.Delete(nil)
+	if expect := writeToBytes(t, tree); bytes.Equal(expect, buffer.Bytes()) == false {
+		t.Errorf("no match \n%q\n%q\n", expect, buffer.Bytes())
+	}
+	if err := writer.WriteSubtree([]byte("d")); err == nil {
+		t.Errorf("write after Close")
+	}
+}
+
+func TestLoadSortedLines(t *testing.T) {
+	lines := "\na\nab\nab\nabc\n\nabd\nb\nbcd\r\nbce\n"
+	tree, err := LoadSortedLines(strings.NewReader(lines), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := New()
+	for _, key := range strings.Fields(lines) {
+		expect.Insert([]byte(key))
+	}
+	if reflect.DeepEqual(expect.Keys(), tree.Keys()) == false || tree.Len() != 7 {
+		t.Errorf("no match \n%s\n%s\n", expect.Keys(), tree.Keys())
+	}
+	if tree.IsMember([]byte("abc")) == false {
+		t.Errorf("nil value func stored %v", tree.ToMap())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	tree, err = LoadSortedLines(strings.NewReader(lines), func(key []byte) interface{} {
+		if bytes.HasPrefix(key, []byte("b")) {
+			return nil
+		}
+		return len(key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := tree.Get([]byte("abc")); value != 3 || tree.IsMember([]byte("bcd")) == false {
+		t.Errorf("values %+v", tree.ToMap())
+	}
+
+	if _, err := LoadSortedLines(strings.NewReader("a\nc\nb\n"), nil); err == nil || err.Error() != "line 3 out of order" {
+		t.Errorf("out of order %v", err)
+	}
+
+	long := strings.Repeat("x", 100<<10)
+	tree, err = LoadSortedLines(strings.NewReader("a\n"+long+"\ny\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != 3 || tree.Has([]byte(long)) == false {
+		t.Errorf("long line Len %d", tree.Len())
+	}
+	defer func(size int64) {
+		MaxStreamFieldSize = size
+	}(MaxStreamFieldSize)
+	MaxStreamFieldSize = 1 << 16
+	if _, err := LoadSortedLines(strings.NewReader(long), nil); err != bufio.ErrTooLong {
+		t.Errorf("expect bufio.ErrTooLong,got %v", err)
+	}
+}
+
+/*
+files.txt sorted,200k keys
+BenchmarkLoadInsertLines 	      10	 115967298 ns/op	37408558 B/op	  794913 allocs/op
+BenchmarkLoadSortedLines 	      12	  95963548 ns/op	37409132 B/op	  794919 allocs/op
+*/
+func BenchmarkLoadInsertLines(b *testing.B) {
+	data := loadFilesData(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		tree := New()
+		for scanner.Scan() {
+			if text := scanner.Bytes(); len(text) > 0 {
+				tree.Insert(text)
+			}
+		}
+	}
+}
+
+func BenchmarkLoadSortedLines(b *testing.B) {
+	data := loadFilesData(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadSortedLines(bytes.NewReader(data), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// loadFilesData returns files.txt sorted,as LoadSortedLines needs
+func loadFilesData(b *testing.B) []byte {
+	data, err := ioutil.ReadFile("../files.txt")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	sort.Slice(lines, func(i, j int) bool {
+		return bytes.Compare(lines[i], lines[j]) < 0
+	})
+	return bytes.Join(lines, []byte("\n"))
+}
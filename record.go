@@ -0,0 +1,76 @@
+package rtree
+
+type OpType byte
+
+const (
+	OpInsert OpType = iota
+	OpReplaceOrInsert
+	OpDelete
+	OpGetOrInsert
+	OpSet
+	OpDeletePrefix
+	// OpDeleteRange holds from in Key and to in Value
+	OpDeleteRange
+	// OpTruncateHead and OpTruncateTail hold n in Value
+	OpTruncateHead
+	OpTruncateTail
+	OpClear
+)
+
+type Op struct {
+	Type  OpType
+	Key   []byte
+	Value interface{}
+}
+
+type recorder struct {
+	ops []Op
+}
+
+func (r *recorder) record(opType OpType, key []byte, value interface{}) {
+	r.ops = append(r.ops, Op{Type: opType, Key: bytesCopy(key), Value: value})
+}
+
+func (tree *Tree) StartRecording() {
+	if tree.recorder == nil {
+		tree.recorder = &recorder{}
+	}
+}
+
+func (tree *Tree) StopRecording() []Op {
+	if tree.recorder == nil {
+		return nil
+	}
+	ops := tree.recorder.ops
+	tree.recorder = nil
+	return ops
+}
+
+func ReplayOps(ops []Op) *Tree {
+	tree := New()
+	for _, op := range ops {
+		switch op.Type {
+		case OpInsert:
+			tree.Insert(op.Key)
+		case OpReplaceOrInsert:
+			tree.ReplaceOrInsert(op.Key, op.Value)
+		case OpDelete:
+			tree.Delete(op.Key)
+		case OpGetOrInsert:
+			tree.GetOrInsert(op.Key, op.Value)
+		case OpSet:
+			tree.Set(op.Key, op.Value)
+		case OpDeletePrefix:
+			tree.DeletePrefix(op.Key)
+		case OpDeleteRange:
+			tree.DeleteRange(op.Key, op.Value.([]byte))
+		case OpTruncateHead:
+			tree.TruncateHead(op.Value.(int))
+		case OpTruncateTail:
+			tree.TruncateTail(op.Value.(int))
+		case OpClear:
+			tree.Clear()
+		}
+	}
+	return tree
+}
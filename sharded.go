@@ -0,0 +1,123 @@
+package rtree
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// shardKeyBytes leading key bytes pick the shard,so keys sharing them stay in
+// one tree
+const shardKeyBytes = 8
+
+type shard struct {
+	mutex sync.RWMutex
+	tree  *Tree
+}
+
+// ShardedTree spreads keys over several trees each with its own lock,so
+// writers to different shards don't wait on each other. Walk pays for it by
+// merging the shards in key order
+type ShardedTree struct {
+	shards []shard
+}
+
+func NewShardedTree(shards int) (*ShardedTree, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("bad shards count %d", shards)
+	}
+	s := &ShardedTree{shards: make([]shard, shards)}
+	for i := range s.shards {
+		s.shards[i].tree = New()
+	}
+	return s, nil
+}
+
+func (s *ShardedTree) shard(key []byte) *shard {
+	if len(key) > shardKeyBytes {
+		key = key[:shardKeyBytes]
+	}
+	// fnv-1a
+	hash := uint32(2166136261)
+	for _, c := range key {
+		hash ^= uint32(c)
+		hash *= 16777619
+	}
+	return &s.shards[hash%uint32(len(s.shards))]
+}
+
+func (s *ShardedTree) Get(key []byte) (interface{}, bool) {
+	shard := s.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	return shard.tree.Get(key)
+}
+
+func (s *ShardedTree) Find(key []byte) bool {
+	shard := s.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	return shard.tree.Has(key)
+}
+
+func (s *ShardedTree) Insert(key []byte) {
+	shard := s.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.tree.Insert(key)
+}
+
+func (s *ShardedTree) ReplaceOrInsert(key []byte, val interface{}) interface{} {
+	shard := s.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.tree.ReplaceOrInsert(key, val)
+}
+
+func (s *ShardedTree) Delete(key []byte) {
+	shard := s.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.tree.Delete(key)
+}
+
+func (s *ShardedTree) Len() int {
+	var count int
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.RLock()
+		count += shard.tree.Len()
+		shard.mutex.RUnlock()
+	}
+	return count
+}
+
+// Walk visits a snapshot of every shard in key order,taking each shard's
+// lock only to Clone it. the snapshots of different shards are not taken at
+// the same instant
+func (s *ShardedTree) Walk(f func(key []byte, value interface{}) bool) {
+	its := make([]*Iterator, 0, len(s.shards))
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.Lock()
+		clone := shard.tree.Clone()
+		shard.mutex.Unlock()
+		if it := clone.Iterator(); it.Next() {
+			its = append(its, it)
+		}
+	}
+	for len(its) != 0 {
+		min := 0
+		for i := 1; i < len(its); i++ {
+			if bytes.Compare(its[i].Key(), its[min].Key()) < 0 {
+				min = i
+			}
+		}
+		if f(its[min].Key(), its[min].Value()) == false {
+			return
+		}
+		if its[min].Next() == false {
+			its = append(its[:min], its[min+1:]...)
+		}
+	}
+}
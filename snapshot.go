@@ -0,0 +1,49 @@
+package rtree
+
+// Snapshot is a read-only copy-on-write view,later writes to the tree it
+// was taken from are not visible through it
+type Snapshot struct {
+	tree *Tree
+}
+
+func (tree *Tree) Snapshot() *Snapshot {
+	return &Snapshot{tree: tree.Clone()}
+}
+
+func (s *Snapshot) Get(key []byte) (interface{}, bool) {
+	return s.tree.Get(key)
+}
+
+func (s *Snapshot) Has(key []byte) bool {
+	return s.tree.Has(key)
+}
+
+// Deprecated: Find is an exact match,use Has
+func (s *Snapshot) Find(key []byte) bool {
+	return s.tree.Has(key)
+}
+
+func (s *Snapshot) Len() int {
+	return s.tree.Len()
+}
+
+func (s *Snapshot) Walk(f func(prefixes [][]byte, val interface{}) bool) {
+	s.tree.Walk(f)
+}
+
+func (s *Snapshot) WalkKeys(f func(key []byte, value interface{}) bool) {
+	s.tree.WalkKeys(f)
+}
+
+func (s *Snapshot) WalkRangeBounds(lo []byte, loInc bool, hi []byte, hiInc bool,
+	f func(key []byte, value interface{}) bool) {
+	s.tree.WalkRangeBounds(lo, loInc, hi, hiInc, f)
+}
+
+func (s *Snapshot) AscendRange(from, to []byte, f func(key []byte, value interface{}) bool) {
+	s.tree.AscendRange(from, to, f)
+}
+
+func (s *Snapshot) DescendRange(from, to []byte, f func(key []byte, value interface{}) bool) {
+	s.tree.DescendRange(from, to, f)
+}
@@ -0,0 +1,313 @@
+package rtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	ErrUnknownOpCode = errors.New("unknown opCode")
+	ErrStackError    = errors.New("stack error")
+	ErrBrokenStack   = errors.New("broken stack")
+	ErrBadLength     = errors.New("bad length")
+	ErrBadMagic      = errors.New("bad magic")
+	ErrBadVersion    = errors.New("unsupported version")
+	ErrChecksum      = errors.New("checksum mismatch")
+	ErrNoChecksum    = errors.New("missing checksum")
+	ErrTrailingData  = errors.New("data after checksum")
+	ErrEmptyPrefix   = errors.New("empty prefix below the root")
+)
+
+// StreamVersion 3 added PushMember,4 PushNil and 5 PushChain,version 2
+// streams are still read
+const StreamVersion = 5
+
+const minStreamVersion = 2
+
+var streamMagic = []byte{'R', 'T', 'R', 'E'}
+
+func writeStreamHeader(writer io.Writer) (int, error) {
+	return writer.Write(append(append([]byte{}, streamMagic...), StreamVersion))
+}
+
+type checksum uint32
+
+func (c *checksum) Write(p []byte) (int, error) {
+	*c = checksum(crc32.Update(uint32(*c), crc32.IEEETable, p))
+	return len(p), nil
+}
+
+func writeStreamChecksum(writer io.Writer, crc checksum) (int, error) {
+	var trailer [5]byte
+	trailer[0] = Checksum
+	binary.BigEndian.PutUint32(trailer[1:], uint32(crc))
+	return writer.Write(trailer[:])
+}
+
+var MaxStreamFieldSize int64 = 1 << 30
+
+type StreamError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream error at offset %d: %s", e.Offset, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+type streamReader struct {
+	reader *bufio.Reader
+	offset int64
+	crc    checksum
+	// verify is set once a header is read,v1 streams carry no checksum
+	verify   bool
+	verified bool
+}
+
+func newStreamReader(reader io.Reader) *streamReader {
+	bufReader, ok := reader.(*bufio.Reader)
+	if ok == false {
+		bufReader = bufio.NewReader(reader)
+	}
+	return &streamReader{reader: bufReader}
+}
+
+func (r *streamReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.offset++
+		r.crc = checksum(crc32.Update(uint32(r.crc), crc32.IEEETable, []byte{b}))
+	}
+	return b, err
+}
+
+func (r *streamReader) readField(discard bool) ([]byte, error) {
+	size, err := binary.ReadVarint(r)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > MaxStreamFieldSize {
+		return nil, ErrBadLength
+	}
+	if discard {
+		n, err := io.CopyN(&r.crc, r.reader, size)
+		r.offset += n
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	data := make([]byte, size)
+	n, err := io.ReadFull(r.reader, data)
+	r.offset += int64(n)
+	r.crc.Write(data[:n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+func (r *streamReader) readHeader() error {
+	header := make([]byte, len(streamMagic)+1)
+	n, err := io.ReadFull(r.reader, header)
+	r.offset += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return &StreamError{Offset: 0, Err: err}
+	}
+	if bytes.Equal(header[:len(streamMagic)], streamMagic) == false {
+		return &StreamError{Offset: 0, Err: ErrBadMagic}
+	}
+	if version := header[len(streamMagic)]; version < minStreamVersion || version > StreamVersion {
+		return &StreamError{Offset: int64(len(streamMagic)), Err: fmt.Errorf("%w %d", ErrBadVersion, version)}
+	}
+	r.verify = true
+	return nil
+}
+
+// next reads one record, returning io.EOF at a clean end of stream
+func (r *streamReader) next(discard bool) (op byte, prefix []byte, value []byte, err error) {
+	offset := r.offset
+	sum := r.crc
+	defer func() {
+		if err != nil && err != io.EOF {
+			err = &StreamError{Offset: offset, Err: err}
+		}
+	}()
+	if op, err = r.ReadByte(); err != nil {
+		if err == io.EOF && r.verify && r.verified == false {
+			err = ErrNoChecksum
+		}
+		return 0, nil, nil, err
+	}
+	switch op {
+	case Checksum:
+		if r.verify == false {
+			return 0, nil, nil, ErrUnknownOpCode
+		}
+		var expect [4]byte
+		var n int
+		n, err = io.ReadFull(r.reader, expect[:])
+		r.offset += int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if binary.BigEndian.Uint32(expect[:]) != uint32(sum) {
+			return 0, nil, nil, ErrChecksum
+		}
+		r.verified = true
+		if _, err = r.ReadByte(); err == nil {
+			return 0, nil, nil, ErrTrailingData
+		}
+		return 0, nil, nil, err
+	case Pop:
+		return op, nil, nil, nil
+	case Push, PushKey, PushMember, PushNil, PushChain:
+		if prefix, err = r.readField(discard); err != nil {
+			return 0, nil, nil, err
+		}
+		if op != PushKey && op != PushChain {
+			return op, prefix, nil, nil
+		}
+		if value, err = r.readField(discard); err != nil {
+			return 0, nil, nil, err
+		}
+		return op, prefix, value, nil
+	default:
+		return 0, nil, nil, ErrUnknownOpCode
+	}
+}
+
+// chainSegments splits the prefix of a PushChain record by the uvarint
+// lengths in data
+func chainSegments(prefix, data []byte) ([][]byte, error) {
+	var segments [][]byte
+	for len(data) != 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size == 0 || size > uint64(len(prefix)) {
+			return nil, ErrBadLength
+		}
+		data = data[n:]
+		segments = append(segments, prefix[:size:size])
+		prefix = prefix[size:]
+	}
+	if len(segments) == 0 || len(prefix) != 0 {
+		return nil, ErrBadLength
+	}
+	return segments, nil
+}
+
+func ValidateStream(reader io.Reader) (keyCount int, err error) {
+	var depth int
+	// emptyKey is set while the top level empty prefix is open
+	var emptyKey bool
+	streamReader := newStreamReader(reader)
+	if err := streamReader.readHeader(); err != nil {
+		return 0, err
+	}
+	for {
+		offset := streamReader.offset
+		op, prefix, data, err := streamReader.next(false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return keyCount, err
+		}
+		if op == Pop {
+			if depth == 0 {
+				return keyCount, &StreamError{Offset: offset, Err: ErrStackError}
+			}
+			depth--
+			emptyKey = false
+			continue
+		}
+		if op == PushChain {
+			if _, err := chainSegments(prefix, data); err != nil {
+				return keyCount, &StreamError{Offset: offset, Err: err}
+			}
+		}
+		// the top level empty prefix holds the empty key,with nothing below it
+		if emptyKey || (len(prefix) == 0 && (depth != 0 || op == Push)) {
+			return keyCount, &StreamError{Offset: offset, Err: ErrEmptyPrefix}
+		}
+		emptyKey = len(prefix) == 0
+		depth++
+		if op != Push && op != PushChain {
+			keyCount++
+		}
+	}
+	if depth != 0 {
+		return keyCount, &StreamError{Offset: streamReader.offset, Err: ErrBrokenStack}
+	}
+	return keyCount, nil
+}
+
+// StreamKeys calls f for every valued key in the stream without building the
+// tree. stopping early skips the checksum verification of the unread part
+func StreamKeys(reader io.Reader, unMarshal func([]byte) (interface{}, error),
+	f func(key []byte, value interface{}) bool) error {
+	var key []byte
+	var lens []int
+	streamReader := newStreamReader(reader)
+	if err := streamReader.readHeader(); err != nil {
+		return err
+	}
+	for {
+		offset := streamReader.offset
+		op, prefix, data, err := streamReader.next(false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case Pop:
+			if len(lens) == 0 {
+				return &StreamError{Offset: offset, Err: ErrStackError}
+			}
+			key = key[:lens[len(lens)-1]]
+			lens = lens[:len(lens)-1]
+		case Push, PushKey, PushMember, PushNil, PushChain:
+			lens = append(lens, len(key))
+			key = append(key, prefix...)
+			if op == Push || op == PushChain {
+				break
+			}
+			var value interface{}
+			switch op {
+			case PushKey:
+				if value, err = unMarshal(data); err != nil {
+					return err
+				}
+			case PushMember:
+				value = Empty
+			}
+			if f(key, value) == false {
+				return nil
+			}
+		}
+	}
+	if len(lens) != 0 {
+		return &StreamError{Offset: streamReader.offset, Err: ErrBrokenStack}
+	}
+	return nil
+}
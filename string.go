@@ -0,0 +1,27 @@
+package rtree
+
+import "unsafe"
+
+// stringBytes aliases s without copying,only for lookups that never retain the key
+func stringBytes(s string) []byte {
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		Cap int
+	}{s, len(s)}))
+}
+
+func (tree *Tree) InsertString(key string, val interface{}) {
+	tree.ReplaceOrInsert([]byte(key), val)
+}
+
+func (tree *Tree) FindString(key string) bool {
+	return tree.Has(stringBytes(key))
+}
+
+func (tree *Tree) GetString(key string) (interface{}, bool) {
+	return tree.Get(stringBytes(key))
+}
+
+func (tree *Tree) DeleteString(key string) {
+	tree.Delete([]byte(key))
+}
@@ -0,0 +1,65 @@
+package rtree
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
+type suggestion struct {
+	key   []byte
+	score int
+}
+
+// suggestions is a min-heap,the worst suggestion is on top to be replaced
+type suggestions []suggestion
+
+func (s suggestions) Len() int {
+	return len(s)
+}
+
+func (s suggestions) Less(i, j int) bool {
+	if s[i].score != s[j].score {
+		return s[i].score < s[j].score
+	}
+	return bytes.Compare(s[i].key, s[j].key) > 0
+}
+
+func (s suggestions) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s *suggestions) Push(x interface{}) {
+	*s = append(*s, x.(suggestion))
+}
+
+func (s *suggestions) Pop() interface{} {
+	old := *s
+	item := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return item
+}
+
+// Suggest returns the n best scored keys under prefix,highest score first and
+// ties in key order. n <= 0 returns every match
+func (tree *Tree) Suggest(prefix []byte, n int, score func(key []byte, value interface{}) int) [][]byte {
+	var top suggestions
+	tree.Extensions(prefix, func(key []byte, value interface{}) bool {
+		item := suggestion{key: key, score: score(key, value)}
+		if n <= 0 || len(top) < n {
+			item.key = bytesCopy(key)
+			heap.Push(&top, item)
+		} else if (suggestions{top[0], item}).Less(0, 1) {
+			item.key = bytesCopy(key)
+			top[0] = item
+			heap.Fix(&top, 0)
+		}
+		return true
+	})
+	sort.Sort(sort.Reverse(top))
+	keys := make([][]byte, len(top))
+	for i, item := range top {
+		keys[i] = item.key
+	}
+	return keys
+}
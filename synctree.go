@@ -0,0 +1,56 @@
+package rtree
+
+import "sync"
+
+type SyncTree struct {
+	mutex sync.RWMutex
+	tree  *Tree
+}
+
+func NewSyncTree() *SyncTree {
+	return &SyncTree{tree: New()}
+}
+
+func (s *SyncTree) Get(key []byte) (interface{}, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.tree.Get(key)
+}
+
+func (s *SyncTree) Find(key []byte) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.tree.Has(key)
+}
+
+func (s *SyncTree) Insert(key []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tree.Insert(key)
+}
+
+func (s *SyncTree) ReplaceOrInsert(key []byte, val interface{}) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tree.ReplaceOrInsert(key, val)
+}
+
+func (s *SyncTree) Delete(key []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tree.Delete(key)
+}
+
+// Snapshot takes the write lock because Clone swaps the tree's cow context
+func (s *SyncTree) Snapshot() *Tree {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tree.Clone()
+}
+
+// ReadOnlySnapshot is Snapshot returning the read-only view
+func (s *SyncTree) ReadOnlySnapshot() *Snapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tree.Snapshot()
+}
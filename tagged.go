@@ -0,0 +1,86 @@
+package rtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+type valueType struct {
+	tag       uint32
+	marshal   func(interface{}) ([]byte, error)
+	unmarshal func([]byte) (interface{}, error)
+}
+
+var valueTypes = struct {
+	sync.RWMutex
+	byTag  map[uint32]*valueType
+	byType map[reflect.Type]*valueType
+}{
+	byTag:  make(map[uint32]*valueType),
+	byType: make(map[reflect.Type]*valueType),
+}
+
+// RegisterValueType lets WriteToTagged and ReBuildTreeTagged round-trip values
+// of the dynamic type of sample,stored under tag
+func RegisterValueType(tag uint32, sample interface{},
+	marshal func(interface{}) ([]byte, error), unmarshal func([]byte) (interface{}, error)) error {
+	typ := reflect.TypeOf(sample)
+	if typ == nil {
+		return fmt.Errorf("nil sample for value type tag %d", tag)
+	}
+	valueTypes.Lock()
+	defer valueTypes.Unlock()
+	if registered, ok := valueTypes.byTag[tag]; ok {
+		return fmt.Errorf("value type tag %d already registered", registered.tag)
+	}
+	if registered, ok := valueTypes.byType[typ]; ok {
+		return fmt.Errorf("value type %s already registered with tag %d", typ, registered.tag)
+	}
+	entry := &valueType{tag: tag, marshal: marshal, unmarshal: unmarshal}
+	valueTypes.byTag[tag] = entry
+	valueTypes.byType[typ] = entry
+	return nil
+}
+
+func taggedMarshal(value interface{}) ([]byte, error) {
+	valueTypes.RLock()
+	entry, ok := valueTypes.byType[reflect.TypeOf(value)]
+	valueTypes.RUnlock()
+	if ok == false {
+		return nil, fmt.Errorf("value type %T not registered", value)
+	}
+	data, err := entry.marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var tagBuf [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(tagBuf[:], uint64(entry.tag))
+	return append(tagBuf[:n:n], data...), nil
+}
+
+func taggedUnMarshal(data []byte) (interface{}, error) {
+	tag, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("bad value type tag")
+	}
+	valueTypes.RLock()
+	entry, ok := valueTypes.byTag[uint32(tag)]
+	valueTypes.RUnlock()
+	if ok == false {
+		return nil, fmt.Errorf("value type tag %d not registered", tag)
+	}
+	return entry.unmarshal(data[n:])
+}
+
+// WriteToTagged is WriteTo prefixing every value with the tag of its
+// registered type
+func (tree *Tree) WriteToTagged(writer io.Writer) (int64, error) {
+	return tree.WriteTo(writer, taggedMarshal)
+}
+
+func ReBuildTreeTagged(reader io.Reader) (*Tree, error) {
+	return ReBuildTree(reader, taggedUnMarshal)
+}
@@ -0,0 +1,169 @@
+package rtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// TreeWriter writes one stream a subtree at a time,so a long export can be
+// driven prefix by prefix and checkpointed between calls. prefixes must come
+// in ascending order and none may be a prefix of the one before,Close ends
+// the stream. the stream loads with ReBuildTree as the tree restricted to the
+// keys written,a path node left with a single subtree comes back as a ghost
+// node that Optimize merges
+type TreeWriter struct {
+	tree      *Tree
+	output    io.Writer
+	writer    io.Writer
+	crc       checksum
+	marshaler func(interface{}) ([]byte, error)
+	buffer    bytes.Buffer
+	// path holds the nodes pushed above the last subtree,still open
+	path []*node
+	last []byte
+	err  error
+}
+
+// NewTreeWriter writes the stream header,the subtrees are read from a Clone
+// of tree so the tree may be written to between WriteSubtree calls
+func NewTreeWriter(tree *Tree, writer io.Writer, marshaler func(interface{}) ([]byte, error)) (*TreeWriter, error) {
+	if _, err := writeStreamHeader(writer); err != nil {
+		return nil, err
+	}
+	w := &TreeWriter{
+		tree:      tree.Clone(),
+		output:    writer,
+		marshaler: marshaler,
+	}
+	w.writer = io.MultiWriter(writer, &w.crc)
+	return w, nil
+}
+
+// WriteSubtree writes the keys under prefix,an empty prefix writes the whole
+// tree. once a write fails every later call returns the same error
+func (w *TreeWriter) WriteSubtree(prefix []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.last != nil && (bytes.Compare(prefix, w.last) <= 0 || bytes.HasPrefix(prefix, w.last)) {
+		return fmt.Errorf("subtree %q not after %q", prefix, w.last)
+	}
+	w.last = append([]byte{}, prefix...)
+	w.err = w.writeSubtree(prefix)
+	return w.err
+}
+
+// Close pops the open nodes and writes the checksum,it does not close the
+// underlying writer
+func (w *TreeWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	for len(w.path) != 0 {
+		if w.err = w.pop(); w.err != nil {
+			return w.err
+		}
+	}
+	if _, w.err = writeStreamChecksum(w.output, w.crc); w.err != nil {
+		return w.err
+	}
+	w.err = fmt.Errorf("tree writer closed")
+	return nil
+}
+
+func (w *TreeWriter) writeSubtree(prefix []byte) error {
+	if len(prefix) == 0 {
+		if w.tree.emptyKeyValue != nil {
+			if err := w.writeNode(&node{value: w.tree.emptyKeyValue}); err != nil {
+				return err
+			}
+		}
+		for _, child := range w.tree.children {
+			if err := w.writeNode(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	path := w.tree.children.subtreePath(prefix)
+	if len(path) == 0 {
+		return nil
+	}
+	// keep the nodes shared with the path of the last subtree open
+	var common int
+	for common < len(w.path) && common < len(path)-1 && w.path[common] == path[common] {
+		common++
+	}
+	for len(w.path) > common {
+		if err := w.pop(); err != nil {
+			return err
+		}
+	}
+	// the keys of the path nodes sort before prefix,so their values are left out
+	for _, n := range path[common : len(path)-1] {
+		if err := w.push(n.prefix, nil); err != nil {
+			return err
+		}
+		w.path = append(w.path, n)
+	}
+	return w.writeNode(path[len(path)-1])
+}
+
+func (w *TreeWriter) writeNode(n *node) error {
+	children := n.children
+	if chain := n.chain(); chain != nil {
+		w.buffer.Reset()
+		encodeChain(&w.buffer, chain)
+		if _, err := w.writer.Write(w.buffer.Bytes()); err != nil {
+			return err
+		}
+		children = chain[len(chain)-1].children
+	} else if err := w.push(n.prefix, n.value); err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := w.writeNode(child); err != nil {
+			return err
+		}
+	}
+	_, err := w.writer.Write([]byte{Pop})
+	return err
+}
+
+func (w *TreeWriter) push(prefix []byte, value interface{}) error {
+	w.buffer.Reset()
+	if err := encodePush(&w.buffer, prefix, value, w.marshaler); err != nil {
+		return err
+	}
+	_, err := w.writer.Write(w.buffer.Bytes())
+	return err
+}
+
+func (w *TreeWriter) pop() error {
+	w.path = w.path[:len(w.path)-1]
+	_, err := w.writer.Write([]byte{Pop})
+	return err
+}
+
+// subtreePath returns the nodes from children down to the one holding the
+// keys under prefix,nil when no key is under it
+func (children children) subtreePath(prefix []byte) []*node {
+	var path []*node
+	for {
+		_, child := children.findNode(prefix[0])
+		if child == nil {
+			return nil
+		}
+		size := prefixLen(child.prefix, prefix)
+		if size == len(prefix) {
+			return append(path, child)
+		}
+		if size < len(child.prefix) {
+			return nil
+		}
+		path = append(path, child)
+		prefix = prefix[size:]
+		children = child.children
+	}
+}
@@ -0,0 +1,41 @@
+package rtree
+
+type TypedTree[V any] struct {
+	tree *Tree
+}
+
+func NewTypedTree[V any]() *TypedTree[V] {
+	return &TypedTree[V]{tree: New()}
+}
+
+// Tree returns the untyped tree,e.g. for WriteTo
+func (t *TypedTree[V]) Tree() *Tree {
+	return t.tree
+}
+
+func (t *TypedTree[V]) Get(key []byte) (V, bool) {
+	var v V
+	value, ok := t.tree.Get(key)
+	if ok {
+		v = value.(V)
+	}
+	return v, ok
+}
+
+func (t *TypedTree[V]) Insert(key []byte, v V) {
+	t.tree.ReplaceOrInsert(key, v)
+}
+
+func (t *TypedTree[V]) Delete(key []byte) {
+	t.tree.Delete(key)
+}
+
+func (t *TypedTree[V]) Len() int {
+	return t.tree.Len()
+}
+
+func (t *TypedTree[V]) Walk(f func(key []byte, v V) bool) {
+	t.tree.WalkKeys(func(key []byte, value interface{}) bool {
+		return f(key, value.(V))
+	})
+}
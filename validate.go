@@ -0,0 +1,48 @@
+package rtree
+
+import "fmt"
+
+// Validate checks the structural invariants of the tree and describes the
+// first one violated
+func (tree *Tree) Validate() error {
+	count, err := tree.children.validate(nil)
+	if err != nil {
+		return err
+	}
+	if tree.emptyKeyValue != nil {
+		count++
+	}
+	if count != tree.count {
+		return fmt.Errorf("count %d but %d keys stored", tree.count, count)
+	}
+	return nil
+}
+
+func (children children) validate(key []byte) (int, error) {
+	var count int
+	for i, child := range children {
+		if len(child.prefix) == 0 {
+			return 0, fmt.Errorf("empty prefix below %q", key)
+		}
+		if i > 0 && children[i-1].prefix[0] >= child.prefix[0] {
+			return 0, fmt.Errorf("children of %q not sorted at %q", key, child.prefix)
+		}
+		childKey := append(key[:len(key):len(key)], child.prefix...)
+		if child.value == nil {
+			switch len(child.children) {
+			case 0:
+				return 0, fmt.Errorf("node %q has no value and no children", childKey)
+			case 1:
+				return 0, fmt.Errorf("node %q has no value and a single child", childKey)
+			}
+		} else {
+			count++
+		}
+		n, err := child.children.validate(childKey)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}